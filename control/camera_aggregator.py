@@ -20,6 +20,8 @@ from dataclasses import dataclass
 import aiohttp
 from aiortc import RTCPeerConnection, RTCSessionDescription
 
+from capture_sync import CaptureSyncCoordinator, FRAME_METADATA_CHANNEL
+
 # Configure logging
 logging.basicConfig(level=logging.INFO, format='%(asctime)s - %(name)s - %(levelname)s - %(message)s')
 logger = logging.getLogger("multi_camera_client")
@@ -62,6 +64,8 @@ class MultiCameraManager:
         self.camera_connections: Dict[str, RTCPeerConnection] = {}
         self.latest_frames: Dict[str, np.ndarray] = {}
         self.frame_lock = Lock()
+        # Capture times of each camera's frames, for the inter-camera skew
+        self.capture_sync = CaptureSyncCoordinator()
         self.running = True
         self.ir_threshold = 200
         self.demo_manager = None
@@ -325,6 +329,7 @@ async def receive_track_for_camera(track, camera_id: str, manager: MultiCameraMa
             frame = await asyncio.wait_for(track.recv(), timeout=5.0)
             img_array = frame.to_ndarray(format="bgr24")
             consecutive_errors = 0
+            manager.capture_sync.on_frame(camera_id, frame.pts)
             
             # Update latest frame
             with manager.frame_lock:
@@ -364,12 +369,20 @@ async def connect_to_camera(camera_config: CameraConfig, manager: MultiCameraMan
             with manager.frame_lock:
                 if camera_config.camera_id in manager.latest_frames:
                     del manager.latest_frames[camera_config.camera_id]
+            manager.capture_sync.forget(camera_config.camera_id)
     
     try:
         pc.addTransceiver("video", direction="recvonly")
     except TypeError:
         logger.warning(f"Transceiver error for camera {camera_config.camera_id}")
     
+    # The node sends each frame's capture time on this channel, which gives the inter-camera skew
+    metadata_channel = pc.createDataChannel(FRAME_METADATA_CHANNEL)
+    
+    @metadata_channel.on("message")
+    def on_metadata(message):
+        manager.capture_sync.on_metadata(camera_config.camera_id, message)
+    
     offer = await pc.createOffer()
     await pc.setLocalDescription(offer)
     
@@ -442,6 +455,12 @@ def process_and_display_composite(manager: MultiCameraManager, dry_run: bool = F
                 cv2.putText(processed_frame, f"Beacons: {len(beacons)}", (10, 90), 
                           cv2.FONT_HERSHEY_SIMPLEX, 0.7, (255, 255, 255), 2)
                 
+                # Add inter-camera capture skew
+                max_skew = manager.capture_sync.max_skew()
+                if max_skew is not None:
+                    cv2.putText(processed_frame, f"Skew: {max_skew:.1f} ms", (10, 120),
+                              cv2.FONT_HERSHEY_SIMPLEX, 0.7, (255, 255, 255), 2)
+                
                 # Display frames
                 if not dry_run:
                     try:
@@ -454,7 +473,9 @@ def process_and_display_composite(manager: MultiCameraManager, dry_run: bool = F
                         dry_run = True
                 else:
                     # In dry run mode, just log the status
-                    logger.info(f"Processed composite frame: {composite.shape}, Beacons: {len(beacons)}")
+                    skew = manager.capture_sync.max_skew()
+                    skew_desc = f", Skew: {skew:.1f} ms" if skew is not None else ""
+                    logger.info(f"Processed composite frame: {composite.shape}, Beacons: {len(beacons)}{skew_desc}")
                 
                 # Handle keyboard input
                 key = 0xFF  # Default to no key pressed
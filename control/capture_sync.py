@@ -0,0 +1,79 @@
+#!/usr/bin/env python3
+"""
+Capture Sync
+Matches frames from several camera nodes to their capture times and measures the skew between cameras.
+"""
+
+import collections
+import logging
+import struct
+import threading
+from typing import Dict, Optional
+
+logger = logging.getLogger("capture_sync")
+
+# Data channel the node sends per-frame capture metadata on, and its record format: capture
+# sequence (uint32), capture wall clock time in ns (int64) and the frame's RTP timestamp (uint32)
+FRAME_METADATA_CHANNEL = "frame-metadata"
+FRAME_METADATA_FORMAT = "!IqI"
+
+# Metadata records kept per camera while their frames are in flight through the decoder
+PENDING_RECORDS = 120
+
+class CaptureSyncCoordinator:
+    """Timestamps each camera's frames against the nodes' common wall clock and reports skew.
+
+    Every node stamps a frame with its wall clock time at capture, so with the nodes' clocks
+    synchronized (NTP, or PTP for sub-millisecond accuracy) those times are comparable across
+    cameras. The skew of a camera is how much older its latest frame is than the newest latest
+    frame of any camera, which is what the tracking engine must compensate when it fuses them.
+    """
+
+    def __init__(self):
+        self._pending: Dict[str, "collections.OrderedDict[int, int]"] = {}
+        self._latest: Dict[str, int] = {}
+        self._lock = threading.Lock()
+
+    def on_metadata(self, camera_id: str, message: bytes):
+        """Record one frame-metadata message received from a camera's node"""
+        try:
+            _, capture_ns, rtp_timestamp = struct.unpack(FRAME_METADATA_FORMAT, message)
+        except struct.error:
+            logger.debug(f"Ignoring malformed frame metadata from camera {camera_id}")
+            return
+        with self._lock:
+            pending = self._pending.setdefault(camera_id, collections.OrderedDict())
+            pending[rtp_timestamp] = capture_ns
+            while len(pending) > PENDING_RECORDS:
+                pending.popitem(last=False)
+
+    def on_frame(self, camera_id: str, pts: Optional[int]) -> Optional[int]:
+        """Note a decoded frame, whose pts is its RTP timestamp, as the camera's latest.
+
+        Returns its capture time in ns, or None when no metadata arrived for it.
+        """
+        with self._lock:
+            pending = self._pending.get(camera_id)
+            capture_ns = pending.pop(pts, None) if pending is not None and pts is not None else None
+            if capture_ns is not None:
+                self._latest[camera_id] = capture_ns
+            return capture_ns
+
+    def forget(self, camera_id: str):
+        """Drop a disconnected camera so it no longer counts towards the skew"""
+        with self._lock:
+            self._pending.pop(camera_id, None)
+            self._latest.pop(camera_id, None)
+
+    def skew(self) -> Dict[str, float]:
+        """Milliseconds each camera's latest frame was captured before the newest latest frame"""
+        with self._lock:
+            if not self._latest:
+                return {}
+            newest = max(self._latest.values())
+            return {camera_id: (newest - capture_ns) / 1e6 for camera_id, capture_ns in self._latest.items()}
+
+    def max_skew(self) -> Optional[float]:
+        """Largest capture time difference between the cameras' latest frames in ms, or None with fewer than two"""
+        skew = self.skew()
+        return max(skew.values()) if len(skew) >= 2 else None
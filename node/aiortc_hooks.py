@@ -0,0 +1,149 @@
+#!/usr/bin/env python3
+"""
+aiortc Hooks
+Every hook into aiortc internals the node relies on, checked against the installed aiortc at startup.
+"""
+
+import logging
+import types
+
+import aiortc
+import av
+from aiortc import RTCRtpSender
+from aiortc import codecs as aiortc_codecs
+from aiortc.codecs import h264 as aiortc_h264
+from aiortc.codecs.h264 import H264Encoder
+from aiortc.rtcdtlstransport import RTCDtlsTransport
+from aiortc.rtp import HeaderExtensionsMap
+
+logger = logging.getLogger("aiortc_hooks")
+
+# The aiortc release the hooks were written against, pinned in requirements.txt
+AIORTC_VERSION = "1.9.0"
+
+# RTCRtpSender keeps what the node needs in private, mostly name-mangled, attributes
+SENDER_ENCODER = "_RTCRtpSender__encoder"
+SENDER_FORCE_KEYFRAME = "_RTCRtpSender__force_keyframe"
+SENDER_PACKET_COUNT = "_RTCRtpSender__packet_count"
+SENDER_OCTET_COUNT = "_RTCRtpSender__octet_count"
+SENDER_RTP_TASK = "_RTCRtpSender__rtp_task"
+SENDER_HEADER_EXTENSIONS_MAP = "_RTCRtpSender__rtp_header_extensions_map"
+SENDER_SSRC = "_ssrc"
+SENDER_ATTRIBUTES = (SENDER_ENCODER, SENDER_FORCE_KEYFRAME, SENDER_PACKET_COUNT, SENDER_OCTET_COUNT,
+                     SENDER_RTP_TASK, SENDER_HEADER_EXTENSIONS_MAP, SENDER_SSRC)
+
+# Private methods wrapped in place, by the class that defines them
+WRAPPED_METHODS = (
+    (RTCRtpSender, "_handle_rtcp_packet"),
+    (RTCDtlsTransport, "_send_rtp"),
+    (H264Encoder, "_encode_frame"),
+    (H264Encoder, "encode"),
+    (HeaderExtensionsMap, "configure"),
+    (HeaderExtensionsMap, "set"),
+)
+
+def missing_hooks():
+    """Names of the hooks the installed aiortc doesn't have"""
+    missing = []
+    try:
+        # Instance attributes only exist once __init__ has run; a sender that never starts
+        # needs nothing from its transport but a state
+        sender = RTCRtpSender("video", types.SimpleNamespace(state="new"))
+    except Exception as e:
+        missing.append(f"RTCRtpSender() ({e})")
+    else:
+        missing += [f"RTCRtpSender.{name}" for name in SENDER_ATTRIBUTES if not hasattr(sender, name)]
+    missing += [f"{owner.__name__}.{name}" for owner, name in WRAPPED_METHODS if not hasattr(owner, name)]
+    if getattr(aiortc_h264, "av", None) is not av:
+        missing.append("aiortc.codecs.h264.av")
+    if not isinstance(getattr(aiortc_codecs, "HEADER_EXTENSIONS", {}).get("video"), list):
+        missing.append("aiortc.codecs.HEADER_EXTENSIONS")
+    return missing
+
+def check_aiortc():
+    """Log one error naming every hook the installed aiortc lacks, returning whether all are there.
+
+    Call it before anything is hooked. Each hook still fails soft (e.g. no keyframe requests),
+    so the node keeps streaming with the features that depend on a missing hook off.
+    """
+    version = getattr(aiortc, "__version__", "unknown")
+    missing = missing_hooks()
+    if missing:
+        logger.error(f"aiortc {version} lacks internals the node hooks into: {', '.join(missing)}. "
+                     f"Encoder instrumentation, keyframe requests, pacing, receiver reports and RTP "
+                     f"header extensions may not work; install aiortc=={AIORTC_VERSION} from requirements.txt")
+        return False
+    if version != AIORTC_VERSION:
+        logger.warning(f"aiortc {version} is not the {AIORTC_VERSION} the node was tested with, "
+                       f"though every internal it hooks into is present")
+    return True
+
+def get_sender_encoder(sender):
+    """Return the encoder aiortc created for a sender, or None before the first frame.
+
+    aiortc keeps a separate encoder per sender but does not expose it publicly.
+    """
+    return getattr(sender, SENDER_ENCODER, None)
+
+def reset_sender_encoder(sender):
+    """Drop a session's encoder so aiortc creates a fresh one (starting on a keyframe) for the next frame"""
+    setattr(sender, SENDER_ENCODER, None)
+
+def request_keyframe(sender):
+    """Ask a session's encoder to emit a keyframe with its next frame"""
+    setattr(sender, SENDER_FORCE_KEYFRAME, True)
+
+def get_sender_ssrc(sender):
+    """The SSRC a sender's RTP packets and RTCP sender reports carry"""
+    return getattr(sender, SENDER_SSRC, None)
+
+def sender_packet_count(sender):
+    """RTP packets a sender has sent, as reported in its RTCP sender reports"""
+    return getattr(sender, SENDER_PACKET_COUNT, 0)
+
+def sender_octet_count(sender):
+    """RTP payload bytes a sender has sent, as reported in its RTCP sender reports"""
+    return getattr(sender, SENDER_OCTET_COUNT, 0)
+
+def rtp_loop_exited(sender):
+    """Whether aiortc's RTP send loop for a sender has finished.
+
+    aiortc ends the loop silently when writing to the transport fails (e.g. the client vanished),
+    as well as when the sender is stopped.
+    """
+    task = getattr(sender, SENDER_RTP_TASK, None)
+    return task is not None and task.done()
+
+def get_header_extensions_map(sender):
+    return getattr(sender, SENDER_HEADER_EXTENSIONS_MAP, None)
+
+def set_header_extensions_map(sender, extensions_map):
+    """Replace a sender's header extension map; before negotiation finishes so it gets configured"""
+    setattr(sender, SENDER_HEADER_EXTENSIONS_MAP, extensions_map)
+
+def wrap_encode_frame(encoder, wrap):
+    """Replace an H.264 encoder's NAL unit generator with wrap(original), returning whether it has one.
+
+    Encoders for other codecs have no such generator and are left alone.
+    """
+    encode_frame = getattr(encoder, "_encode_frame", None)
+    if encode_frame is None:
+        return False
+    encoder._encode_frame = wrap(encode_frame)
+    return True
+
+def wrap_send_rtp(transport, wrap):
+    """Replace the coroutine a DTLS transport sends each RTP packet with by wrap(original)"""
+    transport._send_rtp = wrap(transport._send_rtp)
+
+def wrap_rtcp_handler(sender, wrap):
+    """Replace the coroutine a sender handles each incoming RTCP packet with by wrap(original)"""
+    sender._handle_rtcp_packet = wrap(sender._handle_rtcp_packet)
+
+def replace_h264_av(module):
+    """Swap the av module aiortc's H.264 codec creates its encoder contexts through"""
+    aiortc_h264.av = module
+
+def video_header_extensions():
+    """The list of video header extensions aiortc offers and accepts in SDP, shared with its peer connections"""
+    return aiortc_codecs.HEADER_EXTENSIONS["video"]
@@ -0,0 +1,128 @@
+#!/usr/bin/env python3
+"""
+Archive Recorder
+Records a low frame rate copy of the shared capture to a rolling set of MP4 segments.
+"""
+
+import asyncio
+import fractions
+import glob
+import logging
+import os
+import time
+
+import av
+from av import VideoFrame
+from av.error import FFmpegError
+
+from frame_processing import COLOR_RANGES, tag_color_range, i420_size
+
+logger = logging.getLogger("archive_recorder")
+
+class ArchiveRecorder:
+    """Decimates frames from a FrameHub and encodes them into fixed-length segment files.
+
+    Only the newest max_segments files are kept, so storage stays bounded for a whole show.
+    """
+
+    def __init__(self, hub, directory, size, fps=5, segment_seconds=300, max_segments=24,
+                 codec="libx264", bitrate=500000, color_range="limited"):
+        self.hub = hub
+        self.directory = directory
+        self.size = size
+        self.fps = fps
+        self.segment_seconds = segment_seconds
+        self.max_segments = max_segments
+        self.codec = codec
+        self.bitrate = bitrate
+        self.color_range = color_range
+        self._container = None
+        self._stream = None
+        self._segment_start = 0.0
+        self._frame_index = 0
+
+    async def run(self):
+        os.makedirs(self.directory, exist_ok=True)
+        loop = asyncio.get_event_loop()
+        interval = 1.0 / self.fps
+        sequence = 0
+        next_due = 0.0
+        logger.info(f"Archiving at {self.fps} fps to {self.directory}")
+
+        try:
+            while True:
+                captured = await self.hub.next_frame(sequence)
+                sequence = captured.sequence
+                if captured.monotonic < next_due:
+                    continue
+                # Stay on the decimation grid, but don't try to catch up after a stall
+                next_due += interval
+                if next_due <= captured.monotonic:
+                    next_due = captured.monotonic + interval
+                try:
+                    await loop.run_in_executor(None, self._write, captured)
+                except (FFmpegError, OSError) as e:
+                    logger.error(f"Archive write failed, starting a new segment: {e}")
+                    await loop.run_in_executor(None, self._close_segment)
+        finally:
+            await loop.run_in_executor(None, self._close_segment)
+
+    def _write(self, captured):
+        size = i420_size(captured.array)
+        if size != tuple(self.size):
+            # A segment can't change size part way, so the new size starts a new one
+            logger.info(f"Frame size changed from {self.size[0]}x{self.size[1]} to {size[0]}x{size[1]}")
+            self.size = size
+            self._open_segment(captured)
+        elif self._container is None or captured.monotonic - self._segment_start >= self.segment_seconds:
+            self._open_segment(captured)
+
+        frame = VideoFrame.from_ndarray(captured.array, format="yuv420p")
+        tag_color_range(frame, self.color_range)
+        frame.pts = self._frame_index
+        frame.time_base = fractions.Fraction(1, self.fps)
+        self._frame_index += 1
+        for packet in self._stream.encode(frame):
+            self._container.mux(packet)
+
+    def _open_segment(self, captured):
+        self._close_segment()
+
+        name = time.strftime("archive-%Y%m%d-%H%M%S.mp4", time.localtime(captured.timestamp))
+        path = os.path.join(self.directory, name)
+        self._container = av.open(path, mode="w")
+        self._stream = self._container.add_stream(self.codec, rate=self.fps)
+        self._stream.width, self._stream.height = self.size
+        self._stream.pix_fmt = "yuv420p"
+        self._stream.bit_rate = self.bitrate
+        try:
+            # The encoder writes the range into the VUI when it opens, before any frame is seen
+            self._stream.codec_context.color_range = COLOR_RANGES[self.color_range]
+        except AttributeError:
+            pass
+        self._segment_start = captured.monotonic
+        self._frame_index = 0
+        logger.info(f"Started archive segment {path}")
+
+        self._prune()
+
+    def _close_segment(self):
+        if self._container is None:
+            return
+        try:
+            for packet in self._stream.encode(None):
+                self._container.mux(packet)
+            self._container.close()
+        except (FFmpegError, OSError) as e:
+            logger.error(f"Error closing archive segment: {e}")
+        self._container = None
+        self._stream = None
+
+    def _prune(self):
+        segments = sorted(glob.glob(os.path.join(self.directory, "archive-*.mp4")))
+        for path in segments[:-self.max_segments]:
+            try:
+                os.remove(path)
+                logger.info(f"Removed old archive segment {path}")
+            except OSError as e:
+                logger.warning(f"Could not remove archive segment {path}: {e}")
@@ -0,0 +1,43 @@
+#!/usr/bin/env python3
+"""
+Audit Log
+Append-only record of client connections and stream sessions for post-incident review.
+"""
+
+import json
+import logging
+from datetime import datetime, timezone
+
+logger = logging.getLogger("audit_log")
+
+class AuditLog:
+    """Writes one JSON object per line for each session event.
+
+    Disabled (records are dropped) when no path is configured.
+    """
+
+    def __init__(self, path=None):
+        self.path = path
+        self._file = None
+
+    def open(self):
+        if not self.path:
+            return
+        self._file = open(self.path, 'a', buffering=1)
+        logger.info(f"Writing audit log to {self.path}")
+
+    def close(self):
+        if self._file:
+            self._file.close()
+            self._file = None
+
+    def record(self, event, **fields):
+        """Append an event with a UTC timestamp"""
+        if not self._file:
+            return
+        entry = {"timestamp": datetime.now(timezone.utc).isoformat(), "event": event}
+        entry.update(fields)
+        try:
+            self._file.write(json.dumps(entry) + "\n")
+        except OSError as e:
+            logger.error(f"Could not write audit log entry: {e}")
@@ -0,0 +1,184 @@
+#!/usr/bin/env python3
+"""
+Camera Control Writes
+Coalesces control changes from every control source so the camera only sees a bounded write rate.
+"""
+
+import asyncio
+import logging
+import math
+import time
+
+from log_sampling import SampledLogger
+
+logger = logging.getLogger("camera_controls")
+sampled_logger = SampledLogger(logger)
+
+def _clamp_number(value, low, high):
+    if isinstance(value, bool) or not isinstance(value, (int, float)):
+        return value
+    if not isinstance(low, (int, float)) or not isinstance(high, (int, float)):
+        return value
+    clamped = min(high, max(low, value))
+    return type(value)(clamped) if isinstance(value, int) else clamped
+
+def clamp_controls(values, camera_controls):
+    """Clamp numeric control values to the ranges the driver reports.
+
+    Tuple values (e.g. ColourGains) are clamped element by element. Returns the values to write
+    and a list of (name, requested, applied) for every value that was changed. libcamera
+    reports ranges without a step, so values are not snapped.
+    """
+    applied = {}
+    clamped = []
+    for name, value in values.items():
+        limits = camera_controls.get(name)
+        if not limits or len(limits) < 2:
+            applied[name] = value
+            continue
+        low, high = limits[0], limits[1]
+        if isinstance(value, (tuple, list)):
+            new_value = type(value)(_clamp_number(item, low, high) for item in value)
+        else:
+            new_value = _clamp_number(value, low, high)
+        if new_value != value:
+            clamped.append((name, value, new_value))
+        applied[name] = new_value
+    return applied, clamped
+
+def control_change(previous, value):
+    """Size of a control change: the largest element difference for tuples, infinite for non-numbers"""
+    if isinstance(previous, (tuple, list)) and isinstance(value, (tuple, list)) and len(previous) == len(value):
+        return max((control_change(old, new) for old, new in zip(previous, value)), default=0.0)
+    numbers = (int, float)
+    if isinstance(previous, bool) or isinstance(value, bool) or not (isinstance(previous, numbers) and isinstance(value, numbers)):
+        return 0.0 if previous == value else math.inf
+    return abs(value - previous)
+
+class ControlWriter:
+    """Debounces and rate-limits control writes to the camera.
+
+    Changes submitted within the debounce window are merged so only the latest value
+    of each control is written, and writes never happen faster than max_rate per second.
+    A control with a deadband ignores changes smaller than it from the last value accepted,
+    so jittery input (e.g. an analog fader) doesn't keep nudging the camera.
+    """
+
+    def __init__(self, camera, max_rate=20.0, debounce=0.02, deadband=None):
+        self.camera = camera
+        self.min_interval = 1.0 / max_rate
+        self.debounce = debounce
+        self.deadband = deadband or {}
+        self._pending = {}
+        self._accepted = {}
+        self._last_write = 0.0
+        self._flush_task = None
+        self.writes = 0
+        self.coalesced = 0
+        self.deadbanded = 0
+
+    def submit(self, values):
+        """Queue control values for the next write.
+
+        Values outside the driver's range are clamped rather than rejected by the driver.
+        Returns the values that will actually be written; a change inside its control's
+        deadband isn't written, and the value it keeps is returned instead.
+        """
+        if self.camera is not None:
+            values, clamped = clamp_controls(values, getattr(self.camera, "camera_controls", {}))
+            for name, requested, applied in clamped:
+                logger.warning(f"Clamped {name} from {requested} to {applied} (outside the camera's range)")
+        kept = {}
+        for name, value in list(values.items()):
+            threshold = self.deadband.get(name)
+            previous = self._accepted.get(name)
+            if threshold and previous is not None and control_change(previous, value) < threshold:
+                kept[name] = previous
+                del values[name]
+        self.deadbanded += len(kept)
+        self._accepted.update(values)
+        if values:
+            self.coalesced += len(set(values) & set(self._pending))
+            self._pending.update(values)
+            if self._flush_task is None:
+                self._flush_task = asyncio.ensure_future(self._flush_later())
+        return dict(values, **kept)
+
+    async def _flush_later(self):
+        try:
+            while self._pending:
+                delay = max(self.debounce, self._last_write + self.min_interval - time.monotonic())
+                await asyncio.sleep(delay)
+                values, self._pending = self._pending, {}
+                self._last_write = time.monotonic()
+                self._write(values)
+        finally:
+            self._flush_task = None
+
+    def _write(self, values):
+        if self.camera is None:
+            sampled_logger.warning("no_camera", f"Dropping control write, camera not available: {list(values)}")
+            return
+        try:
+            self.camera.set_controls(values)
+            self.writes += 1
+        except Exception as e:
+            sampled_logger.error("write_error", f"Error writing controls {list(values)}: {e}")
+
+# Controls that define the stream's geometry and timing rather than the image's look
+RESET_EXCLUDED_CONTROLS = {"FrameDurationLimits", "ScalerCrop", "FrameRate"}
+
+def driver_defaults(camera_controls, excluded=RESET_EXCLUDED_CONTROLS):
+    """Return the driver-reported default value of every resettable control"""
+    defaults = {}
+    for name, limits in camera_controls.items():
+        if name in excluded or len(limits) < 3 or limits[2] is None:
+            continue
+        defaults[name] = limits[2]
+    return defaults
+
+# Stops either side of the calibrated 0 EV point accepted when the camera reports no usable range
+EV_LIMIT = 16.0
+
+def bounded_ev(ev, limits, to_ev):
+    """Clamp an EV to what a control's (min, max) driver limits span, or to +/-EV_LIMIT without them.
+
+    to_ev converts the control's raw value to EV. Raises ValueError for infinity and NaN.
+    """
+    if not math.isfinite(ev):
+        raise ValueError(f"EV must be a finite number, got {ev}")
+    low, high = -EV_LIMIT, EV_LIMIT
+    if limits and len(limits) >= 2 and all(isinstance(limit, (int, float)) and limit > 0 for limit in limits[:2]):
+        low, high = to_ev(limits[0]), to_ev(limits[1])
+    return min(high, max(low, ev))
+
+class ExposureCalibration:
+    """Converts exposure time and analogue gain to stops (EV) relative to a calibrated 0 EV point.
+
+    Each doubling of exposure time or gain is +1 EV, so the same EV gives the same image
+    brightness on cameras whose native units differ.
+    """
+
+    def __init__(self, exposure_time, analogue_gain=1.0):
+        self.exposure_time = exposure_time
+        self.analogue_gain = analogue_gain
+
+    def exposure_ev(self, exposure_time):
+        return math.log2(exposure_time / self.exposure_time)
+
+    def gain_ev(self, analogue_gain):
+        return math.log2(analogue_gain / self.analogue_gain)
+
+    def exposure_time_for(self, ev):
+        """Exposure time in microseconds for an exposure EV"""
+        return int(round(self.exposure_time * 2 ** ev))
+
+    def gain_for(self, ev):
+        return self.analogue_gain * 2 ** ev
+
+def calibration_for(model, calibrations):
+    """The ExposureCalibration configured for a camera model (or "default"), or None for raw units"""
+    entry = (calibrations or {}).get(model) or (calibrations or {}).get("default")
+    if entry is None:
+        return None
+    return ExposureCalibration(entry["exposure_time"], entry.get("analogue_gain", 1.0))
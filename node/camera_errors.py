@@ -0,0 +1,119 @@
+#!/usr/bin/env python3
+"""
+Camera Errors
+Categorized camera failures, so recovery can tell errors worth retrying from ones that need a person.
+"""
+
+import errno
+import getpass
+import grp
+import os
+
+DEVICE_NOT_FOUND = "device-not-found"
+PERMISSION_DENIED = "permission-denied"
+FORMAT_UNSUPPORTED = "format-unsupported"
+DEVICE_BUSY = "device-busy"
+TRANSIENT = "transient"
+
+# Categories that can clear up without intervention: a busy device gets released, a missing
+# USB capture device gets replugged. A permission or format problem needs the setup fixed
+RETRYABLE_CATEGORIES = {DEVICE_NOT_FOUND, DEVICE_BUSY, TRANSIENT}
+
+# Category of each errno V4L2 and FFmpeg report when opening or reading a device
+ERRNO_CATEGORIES = {
+    errno.ENOENT: DEVICE_NOT_FOUND,
+    errno.ENODEV: DEVICE_NOT_FOUND,
+    errno.ENXIO: DEVICE_NOT_FOUND,
+    errno.EACCES: PERMISSION_DENIED,
+    errno.EPERM: PERMISSION_DENIED,
+    errno.EINVAL: FORMAT_UNSUPPORTED,
+    errno.ENOTTY: FORMAT_UNSUPPORTED,
+    errno.EOPNOTSUPP: FORMAT_UNSUPPORTED,
+    errno.EBUSY: DEVICE_BUSY,
+    errno.EAGAIN: TRANSIENT,
+    errno.EINTR: TRANSIENT,
+    errno.EIO: TRANSIENT,
+    errno.EPIPE: TRANSIENT,
+    errno.ETIMEDOUT: TRANSIENT,
+}
+
+# Picamera2 and libcamera raise plain exceptions, so fall back to their wording
+MESSAGE_CATEGORIES = [
+    ("device or resource busy", DEVICE_BUSY),
+    ("failed to acquire camera", DEVICE_BUSY),
+    ("no cameras", DEVICE_NOT_FOUND),
+    ("permission denied", PERMISSION_DENIED),
+    ("not supported", FORMAT_UNSUPPORTED),
+]
+
+# Group that owns camera device nodes on Raspberry Pi OS and most distributions
+VIDEO_GROUP = "video"
+
+# Gives VIDEO_GROUP the V4L2 and media controller nodes libcamera and FFmpeg open
+UDEV_RULE_PATH = "/etc/udev/rules.d/99-followspot-camera.rules"
+UDEV_RULE = f'SUBSYSTEM=="video4linux|media", GROUP="{VIDEO_GROUP}", MODE="0660"'
+
+def permission_guidance(device=None):
+    """Explain how to give the node's user access to the camera, with the commands to run.
+
+    A user added to VIDEO_GROUP only gets it in new logins, so a user listed in the group
+    whose process doesn't have it is told to restart instead.
+    """
+    target = device or "the camera devices"
+    try:
+        user = getpass.getuser()
+    except (KeyError, OSError):
+        user = "$USER"
+    try:
+        group = grp.getgrnam(VIDEO_GROUP)
+    except KeyError:
+        group = None
+
+    if group is not None and user in group.gr_mem and group.gr_gid not in os.getgroups():
+        return (f"User {user} is in the {VIDEO_GROUP} group but this process started before it was added. "
+                f"Log out and back in (or reboot, or restart the node's service) so it can open {target}")
+    if group is not None and group.gr_gid in os.getgroups():
+        # Already in the group, so the device node itself isn't group accessible
+        return (f"User {user} is in the {VIDEO_GROUP} group but can't open {target}, so the device isn't "
+                f"owned by it. Add a udev rule giving the group access, then replug or reboot: "
+                f"echo '{UDEV_RULE}' | sudo tee {UDEV_RULE_PATH} && sudo udevadm control --reload-rules "
+                f"&& sudo udevadm trigger")
+    return (f"User {user} can't open {target}. Add it to the {VIDEO_GROUP} group with "
+            f"`sudo usermod -aG {VIDEO_GROUP} {user}`, then log out and back in (or restart the node's service)")
+
+class CameraError(Exception):
+    """A camera failure with its category, wrapping the underlying error"""
+
+    def __init__(self, category, cause, device=None):
+        super().__init__(str(cause))
+        self.category = category
+        self.cause = cause
+        self.device = device
+
+    @property
+    def retryable(self):
+        return self.category in RETRYABLE_CATEGORIES
+
+    @property
+    def hint(self):
+        """What to do about the error, for the categories a person can fix with a known command"""
+        if self.category == PERMISSION_DENIED:
+            return permission_guidance(self.device)
+        return None
+
+    def __str__(self):
+        return f"{self.category}: {self.cause}"
+
+def classify_camera_error(error, device=None):
+    """Wrap an exception from opening or reading a camera in a CameraError with its category"""
+    if isinstance(error, CameraError):
+        return error
+    # FFmpegError carries the errno of the failed call like OSError does
+    category = ERRNO_CATEGORIES.get(getattr(error, "errno", None))
+    if category is None:
+        message = str(error).lower()
+        category = next((category for text, category in MESSAGE_CATEGORIES if text in message), None)
+    if category is None:
+        # A camera index past the last camera
+        category = DEVICE_NOT_FOUND if isinstance(error, IndexError) else TRANSIENT
+    return CameraError(category, error, device)
@@ -0,0 +1,57 @@
+#!/usr/bin/env python3
+"""
+Control Presets
+Named sets of image control values ("looks") that operators save and recall mid-show.
+"""
+
+import json
+import logging
+import os
+
+logger = logging.getLogger("control_presets")
+
+class ControlPresetStore:
+    """Named control presets persisted in the node's state file.
+
+    The state file is a JSON object; presets live under its "control_presets" key so other
+    runtime state can share the file.
+    """
+
+    def __init__(self, path):
+        self.path = path
+        self.presets = {}
+
+    def load(self):
+        state = self._read_state()
+        self.presets = state.get("control_presets", {})
+        if self.presets:
+            logger.info(f"Loaded {len(self.presets)} control presets from {self.path}")
+
+    def save(self, name, values):
+        self.presets[name] = values
+        self._write()
+
+    def delete(self, name):
+        if self.presets.pop(name, None) is not None:
+            self._write()
+            return True
+        return False
+
+    def _read_state(self):
+        if not os.path.exists(self.path):
+            return {}
+        try:
+            with open(self.path, 'r') as f:
+                return json.load(f)
+        except (OSError, ValueError) as e:
+            logger.error(f"Could not read state file {self.path}: {e}")
+            return {}
+
+    def _write(self):
+        state = self._read_state()
+        state["control_presets"] = self.presets
+        # Write then rename so a power cut mid-write can't corrupt the presets
+        temp_path = self.path + ".tmp"
+        with open(temp_path, 'w') as f:
+            json.dump(state, f, indent=2, default=list)
+        os.replace(temp_path, self.path)
@@ -0,0 +1,76 @@
+#!/usr/bin/env python3
+"""
+Control Sources
+Pluggable protocols that feed camera control changes into the node, built in or out-of-tree.
+"""
+
+import importlib
+import logging
+
+logger = logging.getLogger("control_sources")
+
+class ControlSource:
+    """A protocol that receives control changes from outside the node.
+
+    Subclasses override start() and stop() to open and close their listener, and pass each
+    change to submit(), which queues it in the node's ControlWriter like any other control
+    change, so writes from every source are coalesced and rate limited together. submit()
+    returns the values that will actually be written, after clamping.
+    """
+
+    name = "source"
+
+    def __init__(self, submit, **options):
+        self.submit = submit
+        self.options = options
+
+    async def start(self):
+        pass
+
+    async def stop(self):
+        pass
+
+class HttpControlSource(ControlSource):
+    """Control changes made through the node's HTTP API.
+
+    The routes are served by the node's web server, so there is nothing to start or stop;
+    handlers submit through this source.
+    """
+
+    name = "http"
+
+# Built-in sources by name; others are given as "module:ClassName"
+CONTROL_SOURCE_CLASSES = {
+    "http": HttpControlSource,
+}
+
+def load_control_source(spec):
+    """Return the ControlSource subclass for a registered name or a "module:ClassName" spec.
+
+    Raises ValueError if it can't be found or isn't a ControlSource.
+    """
+    if spec in CONTROL_SOURCE_CLASSES:
+        return CONTROL_SOURCE_CLASSES[spec]
+    module_name, _, class_name = spec.partition(":")
+    if not module_name or not class_name:
+        raise ValueError(f"Unknown control source '{spec}' (available: {', '.join(CONTROL_SOURCE_CLASSES)}, "
+                         f"or module:ClassName)")
+    try:
+        source_class = getattr(importlib.import_module(module_name), class_name)
+    except (ImportError, AttributeError) as e:
+        raise ValueError(f"Cannot load control source '{spec}': {e}")
+    if not (isinstance(source_class, type) and issubclass(source_class, ControlSource)):
+        raise ValueError(f"Control source '{spec}' is not a ControlSource subclass")
+    return source_class
+
+def parse_control_source(entry):
+    """Split a control_sources entry, a spec string or {"source": spec, "options": {...}}, into (spec, options)"""
+    if isinstance(entry, str):
+        return entry, {}
+    if isinstance(entry, dict) and isinstance(entry.get("source"), str):
+        options = entry.get("options", {})
+        if not isinstance(options, dict):
+            raise ValueError(f"Options of control source '{entry['source']}' must be an object")
+        return entry["source"], options
+    raise ValueError(f"Invalid control source {entry!r}, expected \"module:ClassName\" or "
+                     f"{{\"source\": ..., \"options\": {{...}}}}")
@@ -0,0 +1,300 @@
+#!/usr/bin/env python3
+"""
+Frame Hub
+Single camera capture loop whose frames are shared by every consumer (WebRTC tracks, recorders).
+"""
+
+import asyncio
+import collections
+import logging
+import time
+from dataclasses import dataclass
+
+import numpy as np
+
+from camera_errors import classify_camera_error
+from log_sampling import SampledLogger
+
+logger = logging.getLogger("frame_hub")
+sampled_logger = SampledLogger(logger)
+
+# Without an explicit limit, buffers over this multiple of a full I420 frame are dropped unexamined
+FRAME_BYTES_HEADROOM = 2
+
+class IncompleteFrameError(Exception):
+    """Raised when a captured buffer does not hold a complete frame"""
+
+class EmptyFrameError(IncompleteFrameError):
+    """Raised when the camera hands over a zero-length buffer, which some drivers occasionally do"""
+
+class OversizedFrameError(IncompleteFrameError):
+    """Raised when a buffer is far larger than any frame of the configured size, e.g. a corrupt driver buffer"""
+
+class CaptureTimeoutError(Exception):
+    """Raised when the camera doesn't deliver a frame within the capture timeout"""
+
+@dataclass
+class CapturedFrame:
+    """A processed frame and when it was captured"""
+    sequence: int
+    array: np.ndarray
+    timestamp: float  # Wall clock time (time.time())
+    monotonic: float  # Monotonic clock time (time.monotonic())
+
+# What a full send queue does with a new frame: discard its oldest frame, discard the new
+# frame, or make the capture loop wait until the consumer catches up
+DROP_POLICIES = ("drop-oldest", "drop-newest", "block")
+
+class FrameQueue:
+    """Bounded queue of frames for one consumer, subscribed to a FrameHub.
+
+    What happens when it is full is set by policy, one of DROP_POLICIES. "block" holds up
+    the capture loop, and so every other consumer, while this one is behind.
+    """
+
+    def __init__(self, size, policy, stats):
+        if policy not in DROP_POLICIES:
+            raise ValueError(f"Unknown drop policy '{policy}', expected one of: {', '.join(DROP_POLICIES)}")
+        self.size = size
+        self.policy = policy
+        self.stats = stats
+        self._frames = collections.deque()
+        self._condition = asyncio.Condition()
+        self.closed = False
+        self.drops = 0
+
+    async def close(self):
+        """Stop accepting frames, releasing a capture loop blocked on this queue"""
+        async with self._condition:
+            self.closed = True
+            self._frames.clear()
+            self._condition.notify_all()
+
+    async def put(self, frame):
+        async with self._condition:
+            if self.closed:
+                return
+            if len(self._frames) >= self.size:
+                if self.policy == "drop-oldest":
+                    self._frames.popleft()
+                    self.drops += 1
+                    self.stats.count("send_queue_drops")
+                elif self.policy == "drop-newest":
+                    self.drops += 1
+                    self.stats.count("send_queue_drops")
+                    return
+                else:
+                    await self._condition.wait_for(lambda: len(self._frames) < self.size or self.closed)
+                    if self.closed:
+                        return
+            self._frames.append(frame)
+            self._condition.notify_all()
+
+    async def get(self, timeout=None):
+        """Take the next queued frame, raising asyncio.TimeoutError if none arrives within the timeout"""
+        async def wait():
+            async with self._condition:
+                await self._condition.wait_for(lambda: self._frames)
+                frame = self._frames.popleft()
+                # Wake a capture loop blocked on this queue
+                self._condition.notify_all()
+                return frame
+        return await asyncio.wait_for(wait(), timeout)
+
+class FrameRateLimiter:
+    """Soft frame rate cap applied when frames are sent, independent of the camera's rate.
+
+    The effective cap is the lowest of the manual cap and any extra caps (e.g. thermal).
+    """
+
+    def __init__(self, extra_caps=()):
+        self.manual_cap = None
+        self.extra_caps = list(extra_caps)
+
+    @property
+    def max_fps(self):
+        caps = [cap for cap in [self.manual_cap] + [source() for source in self.extra_caps] if cap]
+        return min(caps) if caps else None
+
+    def allows(self, last_sent, now, capture_interval):
+        """Whether a frame captured at now may be sent after one sent at last_sent"""
+        max_fps = self.max_fps
+        if max_fps is None or last_sent is None:
+            return True
+        # Half a capture interval of slack so a cap equal to the capture rate drops nothing
+        return now - last_sent >= 1.0 / max_fps - capture_interval / 2
+
+class FrameHub:
+    """Captures frames once and shares them with any number of consumers.
+
+    Each frame is validated and run through the frame pipeline before it is published.
+    Consumers either wait for frames newer than the last sequence number they saw, or
+    subscribe a FrameQueue that receives every frame subject to its drop policy. The first
+    warmup_frames after each start are discarded while the sensor's AE/AWB settle.
+    """
+
+    def __init__(self, camera, size, pipeline, stats, max_errors=5, warmup_frames=0, capture_timeout=None,
+                 max_frame_bytes=None):
+        self.camera = camera
+        self.size = size
+        self.max_frame_bytes = max_frame_bytes
+        self.pipeline = pipeline
+        self.stats = stats
+        self.max_errors = max_errors
+        self.warmup_frames = warmup_frames
+        self.capture_timeout = capture_timeout
+        self._warmup_remaining = 0
+        self.latest = None
+        self.sequence = 0
+        self.consecutive_errors = 0
+        self.last_error = None
+        # Publish times of recent frames, for the measured frame rate
+        self._published = collections.deque(maxlen=61)
+        self._condition = asyncio.Condition()
+        self._queues = set()
+        self._task = None
+
+    def subscribe(self, size, policy):
+        """Return a FrameQueue that receives each new frame until unsubscribed"""
+        queue = FrameQueue(size, policy, self.stats)
+        self._queues.add(queue)
+        return queue
+
+    def unsubscribe(self, queue):
+        self._queues.discard(queue)
+        asyncio.ensure_future(queue.close())
+
+    def start(self):
+        if self._task is None:
+            self._warmup_remaining = self.warmup_frames
+            self._task = asyncio.ensure_future(self._run())
+
+    async def stop(self):
+        if self._task is not None:
+            self._task.cancel()
+            try:
+                await self._task
+            except asyncio.CancelledError:
+                pass
+            self._task = None
+
+    @property
+    def frame_byte_limit(self):
+        """Largest buffer examined: max_frame_bytes, or FRAME_BYTES_HEADROOM full frames of the configured size"""
+        if self.max_frame_bytes:
+            return self.max_frame_bytes
+        return self.size[0] * self.size[1] * 3 // 2 * FRAME_BYTES_HEADROOM
+
+    def check_complete(self, array):
+        """Raise IncompleteFrameError unless the buffer has the full configured geometry"""
+        if array.size == 0:
+            raise EmptyFrameError("zero-length buffer")
+        if array.nbytes > self.frame_byte_limit:
+            raise OversizedFrameError(f"{array.nbytes} byte buffer exceeds the {self.frame_byte_limit} byte limit")
+        expected = (self.size[1] * 3 // 2, self.size[0])
+        if array.shape != expected:
+            raise IncompleteFrameError(f"expected a {expected} YUV420 buffer, got {array.shape}")
+
+    async def next_frame(self, after_sequence=0, timeout=None):
+        """Wait for a frame newer than after_sequence.
+
+        Raises asyncio.TimeoutError if none arrives within the timeout.
+        """
+        async def wait():
+            async with self._condition:
+                await self._condition.wait_for(
+                    lambda: self.latest is not None and self.latest.sequence > after_sequence)
+                return self.latest
+        return await asyncio.wait_for(wait(), timeout)
+
+    @property
+    def measured_fps(self):
+        """Frames published per second over the last couple of seconds, or None without recent frames"""
+        if len(self._published) < 2 or time.monotonic() - self._published[-1] > 1.0:
+            return None
+        return (len(self._published) - 1) / (self._published[-1] - self._published[0])
+
+    async def _publish(self, array, captured_at):
+        self._published.append(captured_at)
+        self.sequence += 1
+        self.latest = CapturedFrame(self.sequence, array, time.time(), captured_at)
+        async with self._condition:
+            self._condition.notify_all()
+        for queue in list(self._queues):
+            await queue.put(self.latest)
+
+    async def _run(self):
+        loop = asyncio.get_event_loop()
+        while True:
+            try:
+                capture_start = time.monotonic()
+                try:
+                    # A driver that never returns a buffer counts as a capture error, so
+                    # recovery kicks in instead of the loop hanging
+                    array = await asyncio.wait_for(
+                        loop.run_in_executor(None, self.camera.capture_array, "main"), self.capture_timeout)
+                except asyncio.TimeoutError:
+                    raise CaptureTimeoutError(f"no frame from the camera within {self.capture_timeout}s")
+                captured_at = time.monotonic()
+                self.stats.record("capture", captured_at - capture_start)
+
+                if array is None:
+                    raise ValueError("Captured None frame")
+
+                self.check_complete(array)
+                if self._warmup_remaining > 0:
+                    self._warmup_remaining -= 1
+                    self.stats.count("warmup_frames")
+                    if self._warmup_remaining == 0:
+                        logger.info(f"Discarded {self.warmup_frames} warmup frames")
+                    continue
+                array = self.pipeline.process(array)
+                self.stats.record("process", time.monotonic() - captured_at)
+
+                self.consecutive_errors = 0
+                self.last_error = None
+                await self._publish(array, captured_at)
+
+            except asyncio.CancelledError:
+                raise
+
+            except EmptyFrameError as e:
+                # Sent on, an empty frame becomes an empty RTP frame that desyncs decoders
+                self.stats.count("empty_frames")
+                sampled_logger.warning("empty_frame", f"Dropping empty frame from the camera: {e}")
+
+            except OversizedFrameError as e:
+                # Processing or packetizing a buffer of absurd size could exhaust memory
+                self.stats.count("oversized_frames")
+                sampled_logger.warning("oversized_frame", f"Dropping oversized frame from the camera: {e}")
+
+            except IncompleteFrameError as e:
+                # A truncated buffer is a dropped frame, not a camera failure
+                self.stats.count("incomplete_frames")
+                sampled_logger.warning("incomplete_frame", f"Dropping incomplete frame: {e}")
+
+            except Exception as e:
+                error = classify_camera_error(e)
+                self.consecutive_errors += 1
+                self.last_error = str(error)
+                sampled_logger.error("capture_error",
+                                     f"Error capturing frame ({self.consecutive_errors}/{self.max_errors}): {error}")
+
+                # Try to recover camera if we have multiple errors
+                if self.consecutive_errors >= self.max_errors:
+                    await loop.run_in_executor(None, self._recover)
+                else:
+                    await asyncio.sleep(0.1)
+
+    def _recover(self):
+        logger.warning("Too many consecutive errors, attempting camera recovery...")
+        try:
+            # Try to reset the camera
+            self.camera.stop()
+            time.sleep(1)
+            self.camera.start()
+            time.sleep(1)
+            self.consecutive_errors = 0
+            logger.info("Camera recovery attempted")
+        except Exception as recovery_error:
+            logger.error(f"Camera recovery failed: {recovery_error}")
@@ -0,0 +1,341 @@
+#!/usr/bin/env python3
+"""
+Frame Processing
+Image operations applied to captured YUV420 (I420) frames before they are streamed.
+"""
+
+import numpy as np
+
+# Black in limited-range YUV
+BLACK_Y = 16
+BLACK_UV = 128
+# Black luma in full-range YUV
+BLACK_Y_FULL = 0
+
+# FFmpeg AVColorRange values for the supported quantization ranges
+COLOR_RANGES = {"limited": 1, "full": 2}
+
+def black_level(color_range):
+    """Return the black luma value for a quantization range"""
+    return BLACK_Y_FULL if color_range == "full" else BLACK_Y
+
+def tag_color_range(frame, color_range):
+    """Flag a VideoFrame's quantization range so encoders that honour it signal it in the VUI.
+
+    Older PyAV releases don't expose the frame's range, in which case the frame is left untagged.
+    """
+    try:
+        frame.color_range = COLOR_RANGES[color_range]
+    except AttributeError:
+        pass
+    return frame
+
+def parse_aspect(aspect):
+    """Parse an aspect ratio string such as "16:9" into a (width, height) tuple"""
+    try:
+        width, height = (int(part) for part in aspect.split(":"))
+    except (AttributeError, ValueError):
+        raise ValueError(f"Invalid aspect ratio '{aspect}', expected e.g. '16:9'")
+    if width <= 0 or height <= 0:
+        raise ValueError(f"Invalid aspect ratio '{aspect}', both parts must be positive")
+    return width, height
+
+def parse_size(size):
+    """Parse a frame size string such as "1280x720" into a (width, height) tuple"""
+    try:
+        width, height = (int(part) for part in size.lower().split("x"))
+    except (AttributeError, ValueError):
+        raise ValueError(f"Invalid frame size '{size}', expected e.g. '1280x720'")
+    if width <= 0 or height <= 0:
+        raise ValueError(f"Invalid frame size '{size}', both parts must be positive")
+    return width, height
+
+def i420_size(frame):
+    """Return the (width, height) of an I420 frame stored as a (height * 3/2, width) array"""
+    return frame.shape[1], frame.shape[0] * 2 // 3
+
+def split_i420(frame):
+    """Split an I420 frame into its Y, U and V planes"""
+    width, height = i420_size(frame)
+    y = frame[:height]
+    chroma = frame[height:].reshape(2, height // 2, width // 2)
+    return y, chroma[0], chroma[1]
+
+def join_i420(y, u, v):
+    """Join Y, U and V planes back into a single I420 frame"""
+    height, width = y.shape
+    return np.concatenate([y.reshape(-1), u.reshape(-1), v.reshape(-1)]).reshape(height * 3 // 2, width)
+
+def _even(value):
+    return max(2, int(value) // 2 * 2)
+
+def aspect_output_size(width, height, aspect, mode="crop"):
+    """Return the output (width, height) after fitting a frame to an aspect ratio"""
+    aspect_w, aspect_h = parse_aspect(aspect)
+    if width * aspect_h > height * aspect_w:
+        # Source is wider than the target aspect
+        if mode == "crop":
+            return _even(height * aspect_w / aspect_h), height
+        return width, _even(width * aspect_h / aspect_w)
+    if mode == "crop":
+        return width, _even(width * aspect_h / aspect_w)
+    return _even(height * aspect_w / aspect_h), height
+
+def fit_aspect(frame, aspect, mode="crop", black_y=BLACK_Y):
+    """Center-crop ("crop") or letterbox ("pad") an I420 frame to the given aspect ratio"""
+    width, height = i420_size(frame)
+    out_w, out_h = aspect_output_size(width, height, aspect, mode)
+    if (out_w, out_h) == (width, height):
+        return frame
+
+    planes = split_i420(frame)
+    result = []
+    for index, plane in enumerate(planes):
+        scale = 1 if index == 0 else 2
+        plane_w, plane_h = out_w // scale, out_h // scale
+        src_h, src_w = plane.shape
+        if mode == "crop":
+            top = (src_h - plane_h) // 2
+            left = (src_w - plane_w) // 2
+            result.append(plane[top:top + plane_h, left:left + plane_w])
+        else:
+            fill = black_y if index == 0 else BLACK_UV
+            padded = np.full((plane_h, plane_w), fill, dtype=plane.dtype)
+            top = (plane_h - src_h) // 2
+            left = (plane_w - src_w) // 2
+            padded[top:top + src_h, left:left + src_w] = plane
+            result.append(padded)
+    return join_i420(*result)
+
+DEINTERLACE_MODES = ("top", "bottom", "blend")
+
+def _deinterlace_plane(plane, mode):
+    plane = plane.astype(np.uint16)
+    result = plane.copy()
+    if mode == "blend":
+        # Average each line with the next, merging the two fields
+        result[:-1] = (plane[:-1] + plane[1:] + 1) // 2
+    else:
+        # Keep one field and rebuild the other field's lines from the lines above and below
+        height = plane.shape[0]
+        rows = np.arange(1 if mode == "top" else 0, height, 2)
+        above = np.where(rows > 0, rows - 1, rows + 1)
+        below = np.where(rows + 1 < height, rows + 1, rows - 1)
+        result[rows] = (plane[above] + plane[below] + 1) // 2
+    return result.astype(np.uint8)
+
+def deinterlace(frame, mode="blend"):
+    """Deinterlace an I420 frame: keep the "top" or "bottom" field and interpolate the other, or "blend" both"""
+    if mode not in DEINTERLACE_MODES:
+        raise ValueError(f"Unknown deinterlace mode '{mode}', expected one of: {', '.join(DEINTERLACE_MODES)}")
+    return join_i420(*(_deinterlace_plane(plane, mode) for plane in split_i420(frame)))
+
+YUYV_CONVERTERS = ("swscale", "numpy")
+
+# Layouts of 4:2:0 frames handed to encoders: planar U and V, or one plane of interleaved UV
+ENCODER_PIXEL_FORMATS = ("yuv420p", "nv12")
+
+def join_nv12(y, u, v):
+    """Join Y, U and V planes into a single NV12 frame: luma, then U and V interleaved per pixel"""
+    height, width = y.shape
+    uv = np.empty((height // 2, width), dtype=np.uint8)
+    uv[:, 0::2] = u
+    uv[:, 1::2] = v
+    return np.concatenate([y, uv])
+
+def i420_to_nv12(frame):
+    """Repack an I420 frame as NV12, for encoders that take interleaved chroma"""
+    return join_nv12(*split_i420(frame))
+
+def _yuyv_planes(packed):
+    """Split a packed YUYV 4:2:2 frame into Y and vertically subsampled U and V planes"""
+    height = packed.shape[0]
+    packed = packed.reshape(height, -1)
+    y = packed[:, 0::2]
+    # Each 4-byte group is Y0 U Y1 V, so U and V are already at half horizontal resolution
+    u = packed[:, 1::4].astype(np.uint16)
+    v = packed[:, 3::4].astype(np.uint16)
+    u = ((u[0::2] + u[1::2] + 1) >> 1).astype(np.uint8)
+    v = ((v[0::2] + v[1::2] + 1) >> 1).astype(np.uint8)
+    return y, u, v
+
+def yuyv_to_i420(packed):
+    """Convert a packed YUYV 4:2:2 frame ((height, width, 2) or (height, width * 2)) to I420.
+
+    Whole-array slicing and shifts only, so numpy's vectorized loops do the work. Chroma is
+    subsampled vertically by averaging each pair of lines.
+    """
+    return join_i420(*_yuyv_planes(packed))
+
+def yuyv_to_nv12(packed):
+    """Convert a packed YUYV 4:2:2 frame to NV12, subsampling chroma like yuyv_to_i420"""
+    return join_nv12(*_yuyv_planes(packed))
+
+def analyze_exposure(frame, sample_step=4):
+    """Classify the exposure of an I420 frame from a subsampled luminance histogram.
+
+    Returns a dict with the status ("ok", "overexposed", "underexposed" or "clipping"),
+    the mean luminance and the fraction of clipped highlight and crushed shadow pixels.
+    """
+    _, height = i420_size(frame)
+    luma = frame[:height:sample_step, ::sample_step]
+    histogram = np.bincount(luma.reshape(-1), minlength=256)
+    total = max(1, int(histogram.sum()))
+
+    mean = float(np.dot(np.arange(256), histogram) / total)
+    highlights = float(histogram[250:].sum() / total)
+    shadows = float(histogram[:6].sum() / total)
+
+    if highlights > 0.05:
+        status = "clipping"
+    elif mean > 200:
+        status = "overexposed"
+    elif mean < 40 or shadows > 0.5:
+        status = "underexposed"
+    else:
+        status = "ok"
+
+    return {
+        "status": status,
+        "mean_luma": round(mean, 1),
+        "clipped_highlights": round(highlights, 3),
+        "crushed_shadows": round(shadows, 3)
+    }
+
+class FrameProcessor:
+    """A stage in the frame processing pipeline.
+
+    Subclasses override process() to return the (possibly new) frame. Processors that only
+    inspect frames return the frame unchanged.
+    """
+
+    name = "processor"
+
+    def process(self, frame):
+        return frame
+
+class AspectFitProcessor(FrameProcessor):
+    """Crops or letterboxes frames to a fixed aspect ratio"""
+
+    name = "aspect"
+
+    def __init__(self, aspect, mode="crop", black_y=BLACK_Y):
+        parse_aspect(aspect)
+        self.aspect = aspect
+        self.mode = mode
+        self.black_y = black_y
+
+    def process(self, frame):
+        return fit_aspect(frame, self.aspect, self.mode, self.black_y)
+
+class DeinterlaceProcessor(FrameProcessor):
+    """Removes combing from interlaced sources such as SDI capture devices"""
+
+    name = "deinterlace"
+
+    def __init__(self, mode="blend"):
+        if mode not in DEINTERLACE_MODES:
+            raise ValueError(f"Unknown deinterlace mode '{mode}', expected one of: {', '.join(DEINTERLACE_MODES)}")
+        self.mode = mode
+
+    def process(self, frame):
+        return deinterlace(frame, self.mode)
+
+def parse_undistort(calibration):
+    """Parse an undistort setting into (camera matrix, distortion coefficients, calibration size, alpha).
+
+    The camera matrix is OpenCV's 3x3 [[fx, 0, cx], [0, fy, cy], [0, 0, 1]] and the distortion
+    coefficients [k1, k2, p1, p2, k3] (4, 5 or 8 of them, as cv2.calibrateCamera returns).
+    The size is the resolution the calibration was made at (None: the frame size).
+    """
+    try:
+        matrix = np.array(calibration["camera_matrix"], dtype=np.float64)
+        distortion = np.array(calibration["distortion"], dtype=np.float64).reshape(-1)
+        size = calibration.get("size")
+        alpha = float(calibration.get("alpha", 0.0))
+    except (AttributeError, KeyError, TypeError, ValueError) as e:
+        raise ValueError(f"undistort needs a camera_matrix and distortion coefficients ({e})")
+    if matrix.shape != (3, 3):
+        raise ValueError("undistort camera_matrix must be 3x3")
+    if len(distortion) not in (4, 5, 8):
+        raise ValueError("undistort distortion must have 4, 5 or 8 coefficients")
+    if size is not None and (len(size) != 2 or min(size) <= 0):
+        raise ValueError("undistort size must be [width, height]")
+    if not 0.0 <= alpha <= 1.0:
+        raise ValueError("undistort alpha must be between 0 and 1")
+    return matrix, distortion, tuple(size) if size else None, alpha
+
+class UndistortProcessor(FrameProcessor):
+    """Removes lens distortion (e.g. a wide lens's barrel distortion) with OpenCV camera intrinsics.
+
+    Straight lines in the scene come out straight, so pixel positions map linearly to angles
+    for the tracking math. The remap tables are built once per frame size; alpha 0 crops to
+    valid pixels only, 1 keeps the whole sensor image with black corners.
+    """
+
+    name = "undistort"
+
+    def __init__(self, calibration):
+        self.matrix, self.distortion, self.calibration_size, self.alpha = parse_undistort(calibration)
+        self._size = None
+        self._maps = None
+
+    def _build_maps(self, width, height):
+        import cv2
+        matrix = self.matrix.copy()
+        if self.calibration_size and self.calibration_size != (width, height):
+            # Focal lengths and principal point scale with the resolution
+            matrix[0] *= width / self.calibration_size[0]
+            matrix[1] *= height / self.calibration_size[1]
+        new_matrix, _ = cv2.getOptimalNewCameraMatrix(matrix, self.distortion, (width, height), self.alpha)
+        maps = []
+        for scale in (1, 2):
+            # Chroma planes are half size, so their intrinsics are halved too
+            plane_matrix, plane_new = matrix.copy(), new_matrix.copy()
+            plane_matrix[:2] /= scale
+            plane_new[:2] /= scale
+            maps.append(cv2.initUndistortRectifyMap(plane_matrix, self.distortion, None, plane_new,
+                                                    (width // scale, height // scale), cv2.CV_16SC2))
+        return maps
+
+    def process(self, frame):
+        import cv2
+        size = i420_size(frame)
+        if size != self._size:
+            self._maps = self._build_maps(*size)
+            self._size = size
+        y, u, v = split_i420(frame)
+        luma_map, chroma_map = self._maps
+        return join_i420(cv2.remap(y, *luma_map, cv2.INTER_LINEAR),
+                         cv2.remap(u, *chroma_map, cv2.INTER_LINEAR, borderValue=BLACK_UV),
+                         cv2.remap(v, *chroma_map, cv2.INTER_LINEAR, borderValue=BLACK_UV))
+
+class FramePipeline:
+    """Ordered list of processors applied to every captured frame"""
+
+    def __init__(self, processors=None):
+        self.processors = list(processors or [])
+
+    @property
+    def names(self):
+        return [processor.name for processor in self.processors]
+
+    def process(self, frame):
+        for processor in self.processors:
+            frame = processor.process(frame)
+        return frame
+
+def placeholder_frame(width, height, lines=(), black_y=BLACK_Y):
+    """Return a black I420 frame with optional lines of text, e.g. to report a camera error"""
+    frame = np.full((height * 3 // 2, width), BLACK_UV, dtype=np.uint8)
+    frame[:height] = black_y
+
+    try:
+        import cv2
+        luma = frame[:height]
+        for index, line in enumerate(lines):
+            cv2.putText(luma, line, (10, height // 2 + index * 30),
+                        cv2.FONT_HERSHEY_SIMPLEX, 0.5, 235, 1)
+    except ImportError:
+        pass
+    return frame
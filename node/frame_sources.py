@@ -0,0 +1,567 @@
+#!/usr/bin/env python3
+"""
+Frame Sources
+Non-camera frame sources (video files, network streams and V4L2 capture devices) used in place
+of the Pi camera, e.g. to replay a recorded show through the pipeline without hardware.
+"""
+
+import fcntl
+import logging
+import os
+import struct
+import threading
+import time
+
+import av
+from av.error import FFmpegError
+
+from camera_errors import CameraError, FORMAT_UNSUPPORTED
+from frame_processing import yuyv_to_i420
+
+logger = logging.getLogger("frame_sources")
+
+# struct v4l2_capability: driver, card, bus_info, version, capabilities, device_caps, reserved
+V4L2_CAPABILITY_FORMAT = "16s32s32sIII12x"
+# _IOR('V', 0, struct v4l2_capability)
+VIDIOC_QUERYCAP = (2 << 30) | (struct.calcsize(V4L2_CAPABILITY_FORMAT) << 16) | (ord("V") << 8)
+V4L2_CAP_DEVICE_CAPS = 0x80000000
+V4L2_CAPABILITY_FLAGS = {
+    0x00000001: "video_capture",
+    0x00000002: "video_output",
+    0x00001000: "video_capture_mplane",
+    0x00004000: "video_m2m_mplane",
+    0x00008000: "video_m2m",
+    0x00010000: "tuner",
+    0x00020000: "audio",
+    0x00200000: "ext_pix_format",
+    0x00800000: "meta_capture",
+    0x01000000: "readwrite",
+    0x04000000: "streaming",
+    V4L2_CAP_DEVICE_CAPS: "device_caps",
+}
+# struct v4l2_queryctrl: id, type, name, minimum, maximum, step, default_value, flags, reserved
+V4L2_QUERYCTRL_FORMAT = "II32siiiiI8x"
+# struct v4l2_control: id, value
+V4L2_CONTROL_FORMAT = "Ii"
+# _IOWR('V', 36, struct v4l2_queryctrl), _IOWR('V', 27/28, struct v4l2_control)
+VIDIOC_QUERYCTRL = (3 << 30) | (struct.calcsize(V4L2_QUERYCTRL_FORMAT) << 16) | (ord("V") << 8) | 36
+VIDIOC_G_CTRL = (3 << 30) | (struct.calcsize(V4L2_CONTROL_FORMAT) << 16) | (ord("V") << 8) | 27
+VIDIOC_S_CTRL = (3 << 30) | (struct.calcsize(V4L2_CONTROL_FORMAT) << 16) | (ord("V") << 8) | 28
+V4L2_CTRL_FLAG_NEXT_CTRL = 0x80000000
+V4L2_CTRL_FLAG_DISABLED = 0x0001
+# struct v4l2_input: index, name, type, audioset, tuner, std, status, capabilities, reserved,
+# padded to the struct's 8-byte alignment
+V4L2_INPUT_FORMAT = "I32sIIIQII12x4x"
+# _IOWR('V', 26, struct v4l2_input), _IOR('V', 38, int), _IOWR('V', 39, int)
+VIDIOC_ENUMINPUT = (3 << 30) | (struct.calcsize(V4L2_INPUT_FORMAT) << 16) | (ord("V") << 8) | 26
+VIDIOC_G_INPUT = (2 << 30) | (struct.calcsize("i") << 16) | (ord("V") << 8) | 38
+VIDIOC_S_INPUT = (3 << 30) | (struct.calcsize("i") << 16) | (ord("V") << 8) | 39
+V4L2_INPUT_TYPES = {1: "tuner", 2: "camera", 3: "touch"}
+V4L2_INPUT_STATUS_FLAGS = {0x1: "no_power", 0x2: "no_signal", 0x4: "no_color"}
+# struct v4l2_format of a capture buffer: type, then the 200-byte fmt union (aligned like the
+# pointers in it), of which only struct v4l2_pix_format's twelve fields are used
+V4L2_FORMAT_FORMAT = f"I{struct.calcsize('P') - 4}x12I{200 - 12 * 4}x"
+# _IOWR('V', 4/5, struct v4l2_format)
+VIDIOC_G_FMT = (3 << 30) | (struct.calcsize(V4L2_FORMAT_FORMAT) << 16) | (ord("V") << 8) | 4
+VIDIOC_S_FMT = (3 << 30) | (struct.calcsize(V4L2_FORMAT_FORMAT) << 16) | (ord("V") << 8) | 5
+V4L2_BUF_TYPE_VIDEO_CAPTURE = 1
+# Position of v4l2_pix_format.field among the unpacked v4l2_format values
+V4L2_FORMAT_FIELD_INDEX = 4
+# enum v4l2_field
+V4L2_FIELDS = {
+    "any": 0,
+    "none": 1,
+    "top": 2,
+    "bottom": 3,
+    "interlaced": 4,
+    "seq_tb": 5,
+    "seq_bt": 6,
+    "alternate": 7,
+    "interlaced_tb": 8,
+    "interlaced_bt": 9,
+}
+# Field modes capture_field may request
+CAPTURE_FIELDS = ("none", "interlaced", "top", "bottom", "alternate")
+# User class control ids (videodev2.h / v4l2-controls.h)
+V4L2_CID_AUTO_WHITE_BALANCE = 0x0098090C
+V4L2_CID_GAIN = 0x00980913
+V4L2_CID_EXPOSURE_AUTO = 0x009A0901
+V4L2_CID_EXPOSURE_ABSOLUTE = 0x009A0902
+# enum v4l2_exposure_auto_type; UVC cameras mostly offer aperture priority as their auto mode
+V4L2_EXPOSURE_MANUAL = 1
+V4L2_EXPOSURE_APERTURE_PRIORITY = 3
+# The libcamera controls a V4L2 device takes, in the order they must be written (auto modes off
+# before the values they govern): control id and libcamera units per V4L2 unit, None for switches.
+# V4L2 counts exposure in 100 us; gain stays in the driver's own units (calibrate EV per model).
+V4L2_CONTROL_IDS = {
+    "AeEnable": (V4L2_CID_EXPOSURE_AUTO, None),
+    "AwbEnable": (V4L2_CID_AUTO_WHITE_BALANCE, None),
+    "ExposureTime": (V4L2_CID_EXPOSURE_ABSOLUTE, 100),
+    "AnalogueGain": (V4L2_CID_GAIN, 1),
+}
+
+def v4l2_device_name(device):
+    """Return the driver's name for a V4L2 device (e.g. an HDMI capture dongle), or None"""
+    path = f"/sys/class/video4linux/{os.path.basename(device)}/name"
+    try:
+        with open(path, 'r') as f:
+            return f.read().strip()
+    except OSError:
+        return None
+
+def _capability_names(flags):
+    return [name for bit, name in V4L2_CAPABILITY_FLAGS.items() if flags & bit]
+
+def v4l2_query_capabilities(device):
+    """Return a V4L2 device's VIDIOC_QUERYCAP driver, card and bus info, or None if it can't be queried"""
+    try:
+        fd = os.open(device, os.O_RDWR | os.O_NONBLOCK)
+    except OSError as e:
+        logger.warning(f"Could not open {device} to query its capabilities: {e}")
+        return None
+    try:
+        buffer = bytearray(struct.calcsize(V4L2_CAPABILITY_FORMAT))
+        fcntl.ioctl(fd, VIDIOC_QUERYCAP, buffer)
+    except OSError as e:
+        logger.warning(f"VIDIOC_QUERYCAP failed on {device}: {e}")
+        return None
+    finally:
+        os.close(fd)
+
+    driver, card, bus_info, version, capabilities, device_caps = struct.unpack(V4L2_CAPABILITY_FORMAT, buffer)
+    return {
+        "driver": driver.split(b"\0", 1)[0].decode(errors="replace"),
+        "card": card.split(b"\0", 1)[0].decode(errors="replace"),
+        "bus_info": bus_info.split(b"\0", 1)[0].decode(errors="replace"),
+        "version": f"{version >> 16}.{(version >> 8) & 0xFF}.{version & 0xFF}",
+        "capabilities": _capability_names(capabilities),
+        # Only this device node's capabilities, when the driver reports them separately
+        "device_capabilities": _capability_names(device_caps) if capabilities & V4L2_CAP_DEVICE_CAPS else None,
+    }
+
+def v4l2_list_controls(device):
+    """Return {name: descriptor} for the enabled controls of a V4L2 device.
+
+    Each descriptor holds the control's id, type, min, max, step and default.
+    """
+    found = {}
+    fd = os.open(device, os.O_RDWR | os.O_NONBLOCK)
+    try:
+        control_id = V4L2_CTRL_FLAG_NEXT_CTRL
+        while True:
+            buffer = bytearray(struct.pack(V4L2_QUERYCTRL_FORMAT, control_id, 0, b"", 0, 0, 0, 0, 0))
+            try:
+                fcntl.ioctl(fd, VIDIOC_QUERYCTRL, buffer)
+            except OSError:
+                # EINVAL once the last control has been returned
+                break
+            found_id, control_type, name, minimum, maximum, step, default, flags = \
+                struct.unpack(V4L2_QUERYCTRL_FORMAT, buffer)
+            if not flags & V4L2_CTRL_FLAG_DISABLED:
+                found[name.split(b"\0", 1)[0].decode(errors="replace")] = {
+                    "id": found_id, "type": control_type, "min": minimum, "max": maximum,
+                    "step": step, "default": default,
+                }
+            control_id = found_id | V4L2_CTRL_FLAG_NEXT_CTRL
+    finally:
+        os.close(fd)
+    return found
+
+def v4l2_get_control(device, control_id):
+    """Read one V4L2 control's value, raising OSError if the driver refuses"""
+    fd = os.open(device, os.O_RDWR | os.O_NONBLOCK)
+    try:
+        buffer = bytearray(struct.pack(V4L2_CONTROL_FORMAT, control_id, 0))
+        fcntl.ioctl(fd, VIDIOC_G_CTRL, buffer)
+        return struct.unpack(V4L2_CONTROL_FORMAT, buffer)[1]
+    finally:
+        os.close(fd)
+
+def v4l2_set_control(device, control_id, value):
+    """Write one V4L2 control, raising OSError if the driver refuses"""
+    fd = os.open(device, os.O_RDWR | os.O_NONBLOCK)
+    try:
+        fcntl.ioctl(fd, VIDIOC_S_CTRL, bytearray(struct.pack(V4L2_CONTROL_FORMAT, control_id, value)))
+    finally:
+        os.close(fd)
+
+def v4l2_list_inputs(device):
+    """Return the inputs of a V4L2 device (e.g. the SDI inputs of a capture card) in index order.
+
+    Each input has its index, name, type and status flags such as "no_signal".
+    """
+    inputs = []
+    fd = os.open(device, os.O_RDWR | os.O_NONBLOCK)
+    try:
+        while True:
+            buffer = bytearray(struct.pack(V4L2_INPUT_FORMAT, len(inputs), b"", 0, 0, 0, 0, 0, 0))
+            try:
+                fcntl.ioctl(fd, VIDIOC_ENUMINPUT, buffer)
+            except OSError:
+                # EINVAL once the last input has been returned
+                break
+            index, name, input_type, _, _, _, status, _ = struct.unpack(V4L2_INPUT_FORMAT, buffer)
+            inputs.append({
+                "index": index,
+                "name": name.split(b"\0", 1)[0].decode(errors="replace"),
+                "type": V4L2_INPUT_TYPES.get(input_type, str(input_type)),
+                "status": [flag for bit, flag in V4L2_INPUT_STATUS_FLAGS.items() if status & bit],
+            })
+    finally:
+        os.close(fd)
+    return inputs
+
+def v4l2_get_input(device):
+    """Index of the input a V4L2 device is capturing from, raising OSError if the driver refuses"""
+    fd = os.open(device, os.O_RDWR | os.O_NONBLOCK)
+    try:
+        buffer = bytearray(struct.pack("i", 0))
+        fcntl.ioctl(fd, VIDIOC_G_INPUT, buffer)
+        return struct.unpack("i", buffer)[0]
+    finally:
+        os.close(fd)
+
+def v4l2_field_name(field):
+    return next((name for name, value in V4L2_FIELDS.items() if value == field), str(field))
+
+def _v4l2_get_format(fd):
+    buffer = bytearray(struct.calcsize(V4L2_FORMAT_FORMAT))
+    struct.pack_into("I", buffer, 0, V4L2_BUF_TYPE_VIDEO_CAPTURE)
+    fcntl.ioctl(fd, VIDIOC_G_FMT, buffer)
+    return list(struct.unpack(V4L2_FORMAT_FORMAT, buffer))
+
+def v4l2_get_field(device):
+    """Name of the field mode in a V4L2 device's capture format, raising OSError if the driver refuses"""
+    fd = os.open(device, os.O_RDWR | os.O_NONBLOCK)
+    try:
+        return v4l2_field_name(_v4l2_get_format(fd)[V4L2_FORMAT_FIELD_INDEX])
+    finally:
+        os.close(fd)
+
+def v4l2_set_field(device, field):
+    """Request a field mode (a V4L2_FIELDS name) in a V4L2 device's capture format.
+
+    The size and pixel format are kept. Drivers adjust a mode they can't capture to one they
+    can, so the name of the field mode they settled on is returned. Raises OSError if the
+    driver refuses the format, e.g. while another process is streaming from the device.
+    """
+    fd = os.open(device, os.O_RDWR | os.O_NONBLOCK)
+    try:
+        values = _v4l2_get_format(fd)
+        values[V4L2_FORMAT_FIELD_INDEX] = V4L2_FIELDS[field]
+        buffer = bytearray(struct.pack(V4L2_FORMAT_FORMAT, *values))
+        fcntl.ioctl(fd, VIDIOC_S_FMT, buffer)
+        return v4l2_field_name(struct.unpack(V4L2_FORMAT_FORMAT, buffer)[V4L2_FORMAT_FIELD_INDEX])
+    finally:
+        os.close(fd)
+
+class StreamFrameSource:
+    """Decodes a video file, RTSP stream or V4L2 device and serves it like a Picamera2 instance.
+
+    Only the subset of the Picamera2 interface used by the server is provided. Frames are
+    returned as YUV420 (I420) arrays at the requested size, and files loop at their native rate.
+    The input's own resolution may change at any time (e.g. an HDMI source switching modes);
+    on_source_change is then called with the new (width, height, format).
+    """
+
+    def __init__(self, url, size, input_format=None, pixel_formats=None, yuyv_conversion="swscale",
+                 video_input=None, field=None):
+        self.url = url
+        self.size = size
+        self.input_format = input_format
+        self.pixel_formats = pixel_formats
+        self.yuyv_conversion = yuyv_conversion
+        # Input of a multi-input V4L2 device to capture from (None keeps the driver's current one)
+        self.video_input = video_input
+        # V4L2 field mode to request before opening (None keeps the driver's)
+        self.field = field
+        self.is_file = input_format is None and not url.startswith(("rtsp://", "rtsps://", "http://", "https://"))
+        model = v4l2_device_name(url) if input_format == "v4l2" else None
+        self.camera_properties = {"Model": model or f"stream:{url}"}
+        self.device_info = v4l2_query_capabilities(url) if input_format == "v4l2" else None
+        if self.device_info:
+            logger.info(f"V4L2 device {url}: driver={self.device_info['driver']} "
+                        f"card={self.device_info['card']} bus={self.device_info['bus_info']} "
+                        f"version={self.device_info['version']} "
+                        f"capabilities={','.join(self.device_info['capabilities'])}")
+        # The libcamera controls the device takes, as Picamera2's {name: (min, max, default)}
+        self.camera_controls = {}
+        # V4L2 control descriptors, cached because enumerating them is slow on some drivers
+        self.control_descriptors = {}
+        self.camera_config = {"source": url, "size": size, "input": None}
+        self.on_source_change = None
+        self._container = None
+        self._frames = None
+        self._frame_interval = 1 / 30
+        self._next_frame_time = 0.0
+        self._lock = threading.Lock()
+
+    def start(self):
+        options = {"rtsp_transport": "tcp"} if self.url.startswith("rtsp") else {}
+        if self.input_format == "v4l2" and self.video_input is not None:
+            # FFmpeg selects the input (VIDIOC_S_INPUT) before negotiating the format
+            options["channel"] = str(self.video_input)
+        if self.input_format == "v4l2" and self.field is not None:
+            self._request_field()
+        if self.input_format == "v4l2" and self.pixel_formats:
+            self._container = self._open_preferred_format(options)
+        else:
+            self._container = av.open(self.url, format=self.input_format, options=options)
+        stream = self._container.streams.video[0]
+        rate = stream.average_rate or stream.guessed_rate
+        if rate:
+            self._frame_interval = 1 / float(rate)
+        self._frames = self._container.decode(stream)
+        self._next_frame_time = time.monotonic()
+        # A re-opened device may have switched modes, so its control ranges are read again
+        self.refresh_controls()
+        if self.input_format == "v4l2":
+            try:
+                self.camera_config["video_input"] = v4l2_get_input(self.url)
+            except OSError:
+                # Devices with a single input needn't support input selection
+                self.camera_config["video_input"] = None
+            self._check_field()
+        logger.info(f"Opened {'file' if self.is_file else 'stream'} source {self.url} "
+                    f"({1 / self._frame_interval:.1f} fps)")
+
+    def _request_field(self):
+        """Set the configured field mode in the device's format ahead of FFmpeg opening it"""
+        try:
+            negotiated = v4l2_set_field(self.url, self.field)
+        except OSError as e:
+            logger.warning(f"Could not request {self.field} fields from {self.url}: {e}")
+            return
+        if negotiated != self.field:
+            logger.warning(f"Requested {self.field} fields from {self.url}, the driver negotiated {negotiated}")
+        else:
+            logger.info(f"Capturing {negotiated} fields from {self.url}")
+
+    def _check_field(self):
+        """Record the field mode the device ended up capturing, after FFmpeg set its own format"""
+        try:
+            field = v4l2_get_field(self.url)
+        except OSError:
+            field = None
+        self.camera_config["field"] = field
+        if self.field is not None and field is not None and field != self.field:
+            # FFmpeg asks for any field mode, which some drivers answer with their default
+            logger.warning(f"{self.url} is capturing {field} fields after opening, not the requested {self.field}")
+
+    def _open_preferred_format(self, options):
+        """Open the device with the first pixel format in the priority list that it accepts"""
+        skipped = []
+        for pixel_format in self.pixel_formats:
+            try:
+                container = av.open(self.url, format=self.input_format,
+                                    options=dict(options, input_format=pixel_format))
+            except FFmpegError as e:
+                skipped.append(f"{pixel_format} ({e})")
+                continue
+            for reason in skipped:
+                logger.info(f"Skipped pixel format {reason} on {self.url}")
+            logger.info(f"Using pixel format {pixel_format} on {self.url}")
+            self.camera_config["pixel_format"] = pixel_format
+            return container
+        raise CameraError(FORMAT_UNSUPPORTED, f"{self.url} accepted none of the pixel formats "
+                                              f"{self.pixel_formats}: {'; '.join(skipped)}")
+
+    def refresh_controls(self):
+        """Re-read the control descriptors, e.g. after a mode switch changed the ranges"""
+        if self.input_format != "v4l2":
+            return
+        try:
+            self.control_descriptors = v4l2_list_controls(self.url)
+        except OSError as e:
+            logger.warning(f"Could not list the controls of {self.url}: {e}")
+            self.control_descriptors = {}
+        self.camera_controls = {}
+        for name, (control_id, scale) in V4L2_CONTROL_IDS.items():
+            descriptor = self._descriptor(control_id)
+            if descriptor is None:
+                continue
+            if control_id == V4L2_CID_EXPOSURE_AUTO:
+                self.camera_controls[name] = (False, True, descriptor["default"] != V4L2_EXPOSURE_MANUAL)
+            elif scale is None:
+                self.camera_controls[name] = (False, True, bool(descriptor["default"]))
+            else:
+                self.camera_controls[name] = (descriptor["min"] * scale, descriptor["max"] * scale,
+                                              descriptor["default"] * scale)
+
+    def _descriptor(self, control_id):
+        return next((descriptor for descriptor in self.control_descriptors.values()
+                     if descriptor["id"] == control_id), None)
+
+    def list_inputs(self):
+        """The inputs of a V4L2 source, empty for other sources or devices without input selection"""
+        if self.input_format != "v4l2":
+            return []
+        try:
+            return v4l2_list_inputs(self.url)
+        except OSError as e:
+            logger.warning(f"Could not list the inputs of {self.url}: {e}")
+            return []
+
+    def set_input(self, index):
+        """Capture from another input of a V4L2 source, reopening it so the format is renegotiated.
+
+        Raises ValueError for an input the device doesn't have. Call with capture stopped.
+        """
+        inputs = self.list_inputs()
+        if index not in [item["index"] for item in inputs]:
+            raise ValueError(f"{self.url} has no input {index} (inputs: {[item['index'] for item in inputs]})")
+        self.stop()
+        self.video_input = index
+        self.camera_config["input"] = None
+        self.start()
+        logger.info(f"Capturing from input {index} ({inputs[index]['name']}) of {self.url}")
+
+    def read_controls(self):
+        """Current values of the cached controls; only the values are queried"""
+        values = {}
+        for name, descriptor in self.control_descriptors.items():
+            try:
+                values[name] = v4l2_get_control(self.url, descriptor["id"])
+            except OSError:
+                # Write-only and button controls have no value
+                continue
+        return values
+
+    def stop(self):
+        with self._lock:
+            if self._container is not None:
+                self._container.close()
+                self._container = None
+                self._frames = None
+
+    def close(self):
+        self.stop()
+
+    def set_controls(self, values):
+        """Write libcamera control values to a V4L2 device, converted to the driver's units.
+
+        Controls the device doesn't take are logged and skipped; other sources have none.
+        """
+        skipped = [name for name in values if name not in self.camera_controls]
+        if skipped:
+            logger.debug(f"Ignoring controls {self.url} doesn't take: {skipped}")
+        for name, (control_id, scale) in V4L2_CONTROL_IDS.items():
+            if name not in values or name not in self.camera_controls:
+                continue
+            value = values[name]
+            if control_id == V4L2_CID_EXPOSURE_AUTO:
+                # Back to the device's own auto mode, unless that is manual
+                default = self._descriptor(control_id)["default"]
+                auto = default if default != V4L2_EXPOSURE_MANUAL else V4L2_EXPOSURE_APERTURE_PRIORITY
+                raw = auto if value else V4L2_EXPOSURE_MANUAL
+            elif scale is None:
+                raw = int(bool(value))
+            else:
+                raw = int(round(value / scale))
+            try:
+                v4l2_set_control(self.url, control_id, raw)
+            except OSError as e:
+                logger.warning(f"Could not set {name}={value} on {self.url}: {e}")
+
+    def capture_metadata(self):
+        return {}
+
+    def capture_array(self, name="main"):
+        with self._lock:
+            if self._container is None:
+                raise RuntimeError(f"Frame source {self.url} is not started")
+
+            frame = self._next_decoded_frame()
+
+            if self.is_file:
+                # Pace file playback at the file's frame rate, live streams pace themselves
+                delay = self._next_frame_time - time.monotonic()
+                if delay > 0:
+                    time.sleep(delay)
+                self._next_frame_time = max(self._next_frame_time + self._frame_interval,
+                                            time.monotonic() - self._frame_interval)
+
+            self._check_input(frame)
+            if self._converts_directly(frame):
+                return yuyv_to_i420(frame.to_ndarray())
+            width, height = self.size
+            return frame.reformat(width=width, height=height, format="yuv420p").to_ndarray()
+
+    def _converts_directly(self, frame):
+        """Whether a frame skips swscale: YUYV input already at the output size, with numpy conversion chosen"""
+        return (self.yuyv_conversion == "numpy" and frame.format.name == "yuyv422"
+                and (frame.width, frame.height) == tuple(self.size))
+
+    def _check_input(self, frame):
+        """Note changes in the decoded input geometry; frames are always scaled to the output size"""
+        current = (frame.width, frame.height, frame.format.name)
+        previous = self.camera_config["input"]
+        if current == previous:
+            return
+        self.camera_config["input"] = current
+        converter = "numpy" if self._converts_directly(frame) else "swscale"
+        if previous is None:
+            logger.info(f"Input from {self.url} is {current[0]}x{current[1]} {current[2]}, {self._field_order(frame)}, "
+                        f"converted to yuv420p with {converter}")
+            return
+        logger.warning(f"Input from {self.url} changed from {previous[0]}x{previous[1]} {previous[2]} "
+                       f"to {current[0]}x{current[1]} {current[2]}")
+        if self.on_source_change:
+            self.on_source_change(current)
+
+    @staticmethod
+    def _field_order(frame):
+        """Describe the field order the decoder reports for a frame"""
+        if not getattr(frame, "interlaced_frame", False):
+            return "progressive"
+        return "interlaced, top field first" if frame.top_field_first else "interlaced, bottom field first"
+
+    def _next_decoded_frame(self):
+        try:
+            return next(self._frames)
+        except StopIteration:
+            if not self.is_file:
+                raise RuntimeError(f"Stream {self.url} ended")
+            # Loop the file from the start
+            self._container.seek(0)
+            self._frames = self._container.decode(self._container.streams.video[0])
+            return next(self._frames)
+
+class PlaceholderSource:
+    """Serves one fixed frame like a camera, e.g. a maintenance card while the camera is serviced.
+
+    Frames are paced at fps so streams keep their normal timing.
+    """
+
+    def __init__(self, frame, fps=30):
+        self.frame = frame
+        self.camera_properties = {"Model": "placeholder"}
+        self.camera_controls = {}
+        self.control_descriptors = {}
+        self.device_info = None
+        self.camera_config = {"source": "placeholder"}
+        self._frame_interval = 1 / fps
+        self._next_frame_time = 0.0
+
+    def start(self):
+        self._next_frame_time = time.monotonic()
+
+    def stop(self):
+        pass
+
+    def close(self):
+        pass
+
+    def set_controls(self, values):
+        logger.debug(f"Ignoring controls for the placeholder source: {list(values)}")
+
+    def capture_metadata(self):
+        return {}
+
+    def capture_array(self, name="main"):
+        delay = self._next_frame_time - time.monotonic()
+        if delay > 0:
+            time.sleep(delay)
+        self._next_frame_time = max(self._next_frame_time + self._frame_interval,
+                                    time.monotonic() - self._frame_interval)
+        return self.frame.copy()
@@ -0,0 +1,74 @@
+#!/usr/bin/env python3
+"""
+HTTP Auth
+Basic authentication for the node's HTTP API, with per-path user lists and realms.
+"""
+
+import base64
+import binascii
+import hmac
+import logging
+
+from aiohttp import web
+
+logger = logging.getLogger("http_auth")
+
+def parse_basic_auth(header):
+    """Return (username, password) from a Basic Authorization header, or None"""
+    scheme, _, encoded = (header or "").partition(" ")
+    if scheme.lower() != "basic":
+        return None
+    try:
+        username, separator, password = base64.b64decode(encoded.strip()).decode().partition(":")
+    except (binascii.Error, UnicodeDecodeError):
+        return None
+    return (username, password) if separator else None
+
+class PathAuthorizer:
+    """Checks credentials against users and the rule for the longest matching path prefix.
+
+    users maps username to password. paths maps a path prefix to {"users": [...], "realm": ...};
+    a path no rule matches is open to every configured user, and a rule without a realm uses
+    the default realm.
+    """
+
+    def __init__(self, users, paths=None, realm="followspot"):
+        self.users = users
+        self.paths = paths or {}
+        self.realm = realm
+
+    def rule_for(self, path):
+        matches = [prefix for prefix in self.paths if path == prefix or path.startswith(prefix.rstrip("/") + "/")]
+        return self.paths[max(matches, key=len)] if matches else None
+
+    def authenticate(self, header):
+        """Return the username the header's credentials belong to, or None"""
+        credentials = parse_basic_auth(header)
+        if credentials is None:
+            return None
+        username, password = credentials
+        expected = self.users.get(username)
+        # Compare against something even for unknown users so timing doesn't reveal them
+        if not hmac.compare_digest(password.encode(), (expected or "").encode()) or expected is None:
+            return None
+        return username
+
+    def check(self, path, header):
+        """Return (allowed, realm) for a request to path with this Authorization header"""
+        rule = self.rule_for(path)
+        realm = (rule or {}).get("realm") or self.realm
+        username = self.authenticate(header)
+        if username is None:
+            return False, realm
+        if rule is not None and username not in rule.get("users", []):
+            return False, realm
+        return True, realm
+
+    @web.middleware
+    async def middleware(self, request, handler):
+        allowed, realm = self.check(request.path, request.headers.get("Authorization"))
+        if not allowed:
+            logger.info(f"Rejected unauthorized request from {request.remote} for {request.path}")
+            return web.Response(status=401, text="Unauthorized",
+                                headers={"WWW-Authenticate": f'Basic realm="{realm}"'})
+        return await handler(request)
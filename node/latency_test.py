@@ -0,0 +1,107 @@
+#!/usr/bin/env python3
+"""
+Latency Test
+A millisecond clock burned into frames for glass-to-glass tests, and an in-process capture-to-decode timing of the pipeline.
+"""
+
+import fractions
+import logging
+import time
+
+import av
+import cv2
+from av import VideoFrame
+
+from frame_processing import FrameProcessor, i420_size, split_i420, BLACK_UV, BLACK_Y
+
+logger = logging.getLogger("latency_test")
+
+# Seconds between overlay timestamps written to the log
+OVERLAY_LOG_INTERVAL = 1.0
+
+# Stages timed by measure_pipeline_latency, in pipeline order; "total" is capture to decoded
+LATENCY_STAGES = ("process", "encode", "decode", "total")
+
+def format_clock(timestamp):
+    """Wall clock time as HH:MM:SS.mmm"""
+    return time.strftime("%H:%M:%S", time.localtime(timestamp)) + f".{int(timestamp * 1000) % 1000:03d}"
+
+class LatencyOverlayProcessor(FrameProcessor):
+    """Burns the wall clock time, to the millisecond, into the top left corner of every frame.
+
+    Point the camera at a screen showing its own stream next to a running clock synchronized
+    with the node: the clock minus the stamp visible in the stream is the glass-to-glass
+    latency, read straight off a photo of the screen. The stamp is taken as the frame leaves
+    the camera and logged once a second, so it can also be matched against client logs.
+    """
+
+    name = "latency"
+
+    def __init__(self, black_y=BLACK_Y):
+        self.black_y = black_y
+        self._logged = 0.0
+
+    def process(self, frame):
+        now = time.time()
+        text = format_clock(now)
+        width, height = i420_size(frame)
+        # Big enough to read from a photo of a monitor at any resolution
+        scale = max(0.5, height / 360)
+        thickness = max(1, round(scale * 2))
+        (text_w, text_h), baseline = cv2.getTextSize(text, cv2.FONT_HERSHEY_SIMPLEX, scale, thickness)
+        pad = thickness * 4
+        box_w = min(width, text_w + 2 * pad) // 2 * 2
+        box_h = min(height, text_h + baseline + 2 * pad) // 2 * 2
+
+        y, u, v = split_i420(frame)
+        y[:box_h, :box_w] = self.black_y
+        u[:box_h // 2, :box_w // 2] = BLACK_UV
+        v[:box_h // 2, :box_w // 2] = BLACK_UV
+        cv2.putText(y, text, (pad, pad + text_h), cv2.FONT_HERSHEY_SIMPLEX, scale, 235, thickness)
+
+        if now - self._logged >= OVERLAY_LOG_INTERVAL:
+            logger.info(f"Latency overlay: stamped a frame captured at {text}")
+            self._logged = now
+        return frame
+
+def measure_pipeline_latency(camera, pipeline, framerate, seconds, encoder_options):
+    """Capture, process, encode and decode frames in-process, timing each stage of every frame.
+
+    The encoder is libx264 configured like the session encoders, and decoding stands in for
+    the client, so "total" is the node's own share of the latency without the network or a
+    display. Returns {stage: [seconds per frame]} for LATENCY_STAGES.
+    """
+    times = {stage: [] for stage in LATENCY_STAGES}
+    encoder = None
+    decoder = av.CodecContext.create("h264", "r")
+    index = 0
+    start = time.monotonic()
+    while time.monotonic() - start < seconds:
+        array = camera.capture_array("main")
+        captured = time.monotonic()
+        array = pipeline.process(array)
+        processed = time.monotonic()
+
+        if encoder is None:
+            # The pipeline may crop, so the encoder takes the size of the processed frames
+            encoder = av.CodecContext.create("libx264", "w")
+            encoder.width, encoder.height = i420_size(array)
+            encoder.pix_fmt = "yuv420p"
+            encoder.time_base = fractions.Fraction(1, framerate)
+            encoder.options = encoder_options
+        frame = VideoFrame.from_ndarray(array, format="yuv420p")
+        frame.pts = index
+        index += 1
+        packets = encoder.encode(frame)
+        encoded = time.monotonic()
+        decoded_frames = [decoded for packet in packets for decoded in decoder.decode(packet)]
+        decoded = time.monotonic()
+        if not decoded_frames:
+            # Still filling the encoder's lookahead; zerolatency shouldn't need any
+            continue
+
+        times["process"].append(processed - captured)
+        times["encode"].append(encoded - processed)
+        times["decode"].append(decoded - encoded)
+        times["total"].append(decoded - captured)
+    return times
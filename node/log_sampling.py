@@ -0,0 +1,46 @@
+#!/usr/bin/env python3
+"""
+Log Sampling
+Rate-limits log messages from hot paths so a persistent fault doesn't flood the log.
+"""
+
+import logging
+import threading
+import time
+
+# Seconds between repeats of the same message; 0 logs every occurrence
+DEFAULT_SAMPLE_INTERVAL = 1.0
+
+class SampledLogger:
+    """Logs the first occurrence of each message key, then at most one per interval.
+
+    Each repeat that is logged carries the number of occurrences suppressed since the last one.
+    """
+
+    # Shared by every SampledLogger so the interval can be configured in one place
+    interval = DEFAULT_SAMPLE_INTERVAL
+
+    def __init__(self, logger):
+        self.logger = logger
+        self._last_logged = {}
+        self._suppressed = {}
+        self._lock = threading.Lock()
+
+    def log(self, level, key, message):
+        now = time.monotonic()
+        with self._lock:
+            last = self._last_logged.get(key)
+            if last is not None and now - last < self.interval:
+                self._suppressed[key] = self._suppressed.get(key, 0) + 1
+                return
+            suppressed = self._suppressed.pop(key, 0)
+            self._last_logged[key] = now
+        if suppressed:
+            message = f"{message} ({suppressed} similar messages suppressed)"
+        self.logger.log(level, message)
+
+    def warning(self, key, message):
+        self.log(logging.WARNING, key, message)
+
+    def error(self, key, message):
+        self.log(logging.ERROR, key, message)
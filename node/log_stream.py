@@ -0,0 +1,80 @@
+#!/usr/bin/env python3
+"""
+Log Stream
+Tees the node's log records to live subscribers, e.g. a remote controller tailing the log over HTTP.
+"""
+
+import asyncio
+import collections
+import logging
+import threading
+
+# Records kept for a new subscriber's backlog
+BACKLOG_RECORDS = 200
+
+class LogStreamHandler(logging.Handler):
+    """Logging handler that fans records out to subscriber queues on the event loop.
+
+    Each subscriber's queue is bounded; a subscriber that falls behind loses its oldest records
+    (counted in dropped) rather than growing memory or holding up the code that logs. Records
+    logged from worker threads are handed to the loop thread-safely.
+    """
+
+    def __init__(self, max_queue=500):
+        super().__init__()
+        self.max_queue = max_queue
+        self.dropped = 0
+        self._subscribers = {}
+        self._backlog = collections.deque(maxlen=BACKLOG_RECORDS)
+        self._loop = None
+        self._loop_thread = None
+
+    def attach(self, loop):
+        """Deliver records on this event loop; records before then only reach the backlog"""
+        self._loop = loop
+        self._loop_thread = threading.get_ident()
+
+    def subscribe(self, level=logging.INFO, backlog=0):
+        """Return a queue receiving records at or above level, starting with up to backlog recent ones"""
+        queue = asyncio.Queue(maxsize=self.max_queue)
+        for entry in list(self._backlog)[-backlog:] if backlog else []:
+            if entry["levelno"] >= level:
+                queue.put_nowait(entry)
+        self._subscribers[queue] = level
+        return queue
+
+    def unsubscribe(self, queue):
+        self._subscribers.pop(queue, None)
+
+    def emit(self, record):
+        try:
+            entry = {
+                "time": record.created,
+                "level": record.levelname,
+                "levelno": record.levelno,
+                "logger": record.name,
+                "message": record.getMessage(),
+            }
+        except Exception:
+            self.handleError(record)
+            return
+        if self._loop is None:
+            self._backlog.append(entry)
+        elif threading.get_ident() == self._loop_thread:
+            self._deliver(entry)
+        else:
+            try:
+                self._loop.call_soon_threadsafe(self._deliver, entry)
+            except RuntimeError:
+                # The loop has closed during shutdown
+                pass
+
+    def _deliver(self, entry):
+        self._backlog.append(entry)
+        for queue, level in list(self._subscribers.items()):
+            if entry["levelno"] < level:
+                continue
+            if queue.full():
+                queue.get_nowait()
+                self.dropped += 1
+            queue.put_nowait(entry)
@@ -0,0 +1,35 @@
+#!/usr/bin/env python3
+"""
+Media Clock
+Frame timestamps in RTP clock ticks that stay exact at any frame rate.
+"""
+
+import fractions
+
+# RTP clock rate of video (RFC 3551), also used as the frame time base so pts are RTP ticks
+VIDEO_CLOCK_RATE = 90000
+
+class PtsClock:
+    """Hands out the pts of consecutive frames at a fixed frame rate, in ticks of a rate Hz clock.
+
+    The step per frame is kept as an exact fraction and only the pts handed out is truncated,
+    so a frame rate that doesn't divide the clock evenly (e.g. 29.97 fps at 90 kHz) can't make
+    timestamps drift from the capture rate.
+    """
+
+    def __init__(self, rate, fps):
+        self.rate = rate
+        # Through str so a configured 29.97 is exactly 2997/100 rather than the nearest float
+        self.step = fractions.Fraction(rate) / fractions.Fraction(str(fps))
+        self._ticks = None
+
+    def next_pts(self, frames=1):
+        """Return the pts of the next frame, captured frames intervals after the previous one.
+
+        The first frame is at 0 whatever the gap.
+        """
+        if self._ticks is None:
+            self._ticks = fractions.Fraction(0)
+        else:
+            self._ticks += self.step * frames
+        return int(self._ticks)
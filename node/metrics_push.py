@@ -0,0 +1,79 @@
+#!/usr/bin/env python3
+"""
+Metrics Push
+Periodically pushes node metrics to a StatsD server for push-based dashboards.
+"""
+
+import asyncio
+import logging
+import re
+import socket
+from urllib.parse import urlparse
+
+logger = logging.getLogger("metrics_push")
+
+DEFAULT_STATSD_PORT = 8125
+
+def parse_statsd_url(url):
+    """Split a statsd://host[:port] URL into (host, port), raising ValueError for anything else"""
+    parsed = urlparse(url)
+    if parsed.scheme != "statsd" or not parsed.hostname:
+        raise ValueError(f"Unsupported metrics push URL '{url}', expected statsd://host[:port]")
+    return parsed.hostname, parsed.port or DEFAULT_STATSD_PORT
+
+def metric_name(*parts):
+    """Join name parts into a StatsD-safe dotted metric name"""
+    return ".".join(re.sub(r"[^A-Za-z0-9_-]", "_", str(part)) for part in parts)
+
+class StatsdPusher:
+    """Sends gauges and counter increments to StatsD over UDP every interval.
+
+    collect() returns (gauges, counters): gauges are sent as-is, counters are cumulative
+    totals of which only the increase since the last push is sent.
+    """
+
+    def __init__(self, url, prefix, collect, interval=10.0):
+        self.address = parse_statsd_url(url)
+        self.prefix = prefix
+        self.collect = collect
+        self.interval = interval
+        self._last_counters = {}
+        self._socket = None
+
+    async def run(self):
+        self._socket = socket.socket(socket.AF_INET6 if ":" in self.address[0] else socket.AF_INET,
+                                     socket.SOCK_DGRAM)
+        self._socket.setblocking(False)
+        logger.info(f"Pushing metrics to statsd://{self.address[0]}:{self.address[1]} every {self.interval}s")
+        try:
+            while True:
+                await asyncio.sleep(self.interval)
+                self.push()
+        finally:
+            self._socket.close()
+
+    def push(self):
+        gauges, counters = self.collect()
+        lines = [f"{metric_name(self.prefix, name)}:{value}|g"
+                 for name, value in gauges.items() if value is not None]
+        for name, total in counters.items():
+            increase = total - self._last_counters.get(name, 0)
+            self._last_counters[name] = total
+            if increase:
+                lines.append(f"{metric_name(self.prefix, name)}:{increase}|c")
+
+        # Keep datagrams well under a typical MTU
+        batch = []
+        for line in lines:
+            if batch and sum(len(item) + 1 for item in batch) + len(line) > 1400:
+                self._send(batch)
+                batch = []
+            batch.append(line)
+        if batch:
+            self._send(batch)
+
+    def _send(self, lines):
+        try:
+            self._socket.sendto("\n".join(lines).encode(), self.address)
+        except OSError as e:
+            logger.debug(f"Could not push metrics: {e}")
@@ -0,0 +1,121 @@
+#!/usr/bin/env python3
+"""
+MJPEG Streamer
+Encodes the shared capture as JPEG frames for a plain HTTP multipart preview and still snapshots.
+"""
+
+import asyncio
+import logging
+import time
+
+import cv2
+
+logger = logging.getLogger("mjpeg_streamer")
+
+def encode_jpeg(array, quality):
+    """Encode an I420 frame as JPEG bytes"""
+    bgr = cv2.cvtColor(array, cv2.COLOR_YUV2BGR_I420)
+    ok, jpeg = cv2.imencode(".jpg", bgr, [cv2.IMWRITE_JPEG_QUALITY, quality])
+    if not ok:
+        raise ValueError("JPEG encoding failed")
+    return jpeg.tobytes()
+
+class MjpegStreamer:
+    """Shares one JPEG encode per frame between every attached HTTP client.
+
+    Encoding only runs while at least one client is attached.
+    """
+
+    # Names the feed in log messages
+    label = "MJPEG"
+
+    def __init__(self, hub, fps=10, quality=75):
+        self.hub = hub
+        self.fps = fps
+        self.quality = quality
+        self.clients = 0
+        self.sequence = 0
+        self.latest = None
+        self._condition = asyncio.Condition()
+        self._task = None
+
+    def attach(self):
+        self.clients += 1
+        if self._task is None:
+            self._task = asyncio.ensure_future(self._run())
+            logger.info(f"{self.label} client attached, encoding started")
+
+    def detach(self):
+        self.clients -= 1
+        if self.clients <= 0 and self._task is not None:
+            self._task.cancel()
+            self._task = None
+            self.latest = None
+            logger.info(f"Last {self.label} client detached, encoding stopped")
+
+    def encode(self, array):
+        return encode_jpeg(array, self.quality)
+
+    async def next_jpeg(self, after_sequence=0):
+        """Wait for a JPEG newer than after_sequence, returning (sequence, jpeg)"""
+        async with self._condition:
+            await self._condition.wait_for(lambda: self.latest is not None and self.sequence > after_sequence)
+            return self.sequence, self.latest
+
+    async def _run(self):
+        loop = asyncio.get_event_loop()
+        interval = 1.0 / self.fps
+        frame_sequence = 0
+        next_due = 0.0
+        while True:
+            captured = await self.hub.next_frame(frame_sequence)
+            frame_sequence = captured.sequence
+            if captured.monotonic < next_due:
+                continue
+            next_due += interval
+            if next_due <= captured.monotonic:
+                next_due = captured.monotonic + interval
+            try:
+                jpeg = await loop.run_in_executor(None, self.encode, captured.array)
+            except (cv2.error, ValueError) as e:
+                logger.error(f"Could not encode {self.label} frame: {e}")
+                continue
+            async with self._condition:
+                self.sequence += 1
+                self.latest = jpeg
+                self._condition.notify_all()
+
+class SnapshotCache:
+    """Serves still JPEGs of the capture from one shared encode.
+
+    A new JPEG is encoded at most max_fps times per second, and only when the hub has a newer
+    frame, so any number of polling clients cost at most one encode per refresh.
+    """
+
+    def __init__(self, hub, max_fps=2.0, quality=85):
+        self.hub = hub
+        self.max_fps = max_fps
+        self.quality = quality
+        self.encodes = 0
+        self._sequence = 0
+        self._jpeg = None
+        self._captured_at = None
+        self._refreshed = 0.0
+        self._lock = asyncio.Lock()
+
+    async def get(self):
+        """Return (jpeg, capture wall clock time) of a recent frame, or None before the first frame"""
+        async with self._lock:
+            latest = self.hub.latest
+            now = time.monotonic()
+            stale = latest is not None and latest.sequence != self._sequence
+            if stale and (self._jpeg is None or now - self._refreshed >= 1.0 / self.max_fps):
+                loop = asyncio.get_event_loop()
+                self._jpeg = await loop.run_in_executor(None, encode_jpeg, latest.array, self.quality)
+                self._sequence = latest.sequence
+                self._captured_at = latest.timestamp
+                self._refreshed = now
+                self.encodes += 1
+        if self._jpeg is None:
+            return None
+        return self._jpeg, self._captured_at
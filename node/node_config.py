@@ -0,0 +1,525 @@
+#!/usr/bin/env python3
+"""
+Node Server Configuration
+Loads camera node settings from a JSON file, falling back to defaults for anything not set.
+"""
+
+import json
+import logging
+import os
+import socket
+import urllib.request
+from urllib.parse import urlsplit, urlunsplit
+from dataclasses import dataclass, fields
+from typing import Optional
+
+from frame_processing import (parse_aspect, parse_size, parse_undistort, DEINTERLACE_MODES, ENCODER_PIXEL_FORMATS,
+                              YUYV_CONVERTERS)
+from stream_publisher import publish_format
+from frame_hub import DROP_POLICIES
+from frame_sources import CAPTURE_FIELDS
+from metrics_push import parse_statsd_url
+from control_sources import parse_control_source
+from parameter_sets import PARAMETER_SET_MODES
+from system_health import read_board_model, default_pixel_rate
+
+logger = logging.getLogger("node_config")
+
+DEFAULT_CONFIG_PATH = os.path.join(os.path.dirname(os.path.abspath(__file__)),
+                                   "..", "config", "node_config.json")
+DEFAULT_STATE_PATH = os.path.join(os.path.dirname(DEFAULT_CONFIG_PATH), "node_state.json")
+
+# Common capture resolutions, largest first, suggested when a configuration is too demanding
+STANDARD_RESOLUTIONS = [(1920, 1080), (1280, 720), (640, 480), (320, 240)]
+
+# Tuning presets; any setting given explicitly in the config file overrides the preset
+PRESETS = {
+    # Minimum glass-to-glass latency for tracking: fewest buffers, always the freshest frame, a short
+    # GOP to recover fast and one encoder thread so frames aren't held back for slice scheduling
+    "low-latency": {
+        "buffer_count": 2,
+        "frame_queue": False,
+        "idr_interval": 30,
+        "encoder_threads": 1,
+        "send_queue_frames": 1,
+        "drop_policy": "drop-oldest",
+    },
+    # Image quality for recording: larger frames and deeper buffering to avoid drops
+    "quality": {
+        "resolution": [640, 480],
+        "buffer_count": 8,
+        "frame_queue": True,
+    },
+}
+
+# Encoding presets by use case, applied after the tuning preset; explicit settings override them too
+QUALITY_PRESETS = {
+    # Latency and beacon detail: high frame rate, a bitrate floor, frequent IDRs to recover fast
+    # and one encoder thread so frames aren't held back for slice scheduling
+    "tracking": {
+        "framerate": 60,
+        "target_bitrate": 1500000,
+        "min_bitrate": 1000000,
+        "idr_interval": 60,
+        "encoder_threads": 1,
+    },
+    # Cheap monitoring on busy networks: low frame rate and bitrate
+    "preview": {
+        "framerate": 15,
+        "target_bitrate": 500000,
+        "idr_interval": 30,
+        "mjpeg_fps": 5,
+        "tracking_fps": 15,
+        "mjpeg_quality": 60,
+    },
+    # Picture quality for program feeds: high bitrate with a floor against blocky adaptation
+    "broadcast": {
+        "framerate": 30,
+        "target_bitrate": 4000000,
+        "min_bitrate": 2000000,
+        "idr_interval": 60,
+        "mjpeg_quality": 90,
+    },
+    # Compression for long recordings: low bitrates and long GOPs
+    "archive": {
+        "framerate": 30,
+        "target_bitrate": 1000000,
+        "idr_interval": 300,
+        "archive_bitrate": 300000,
+        "replay_bitrate": 500000,
+    },
+}
+
+# Seconds a request to the central configuration server may take before the local file is used
+REMOTE_CONFIG_TIMEOUT = 5.0
+
+STREAM_URL_PREFIXES = ("rtsp://", "rtsps://", "http://", "https://")
+
+# Settings that may hold a URL with credentials in it, redacted wherever the configuration is shown
+URL_SETTINGS = ("source", "publish_url", "remote_config_url", "metrics_push_url")
+REDACTED = "********"
+
+def parse_source(source):
+    """Split a frame source string into (kind, target).
+
+    "camera" or "camera:N" selects a Pi camera, "file:path.mp4" a video file,
+    "v4l2:/dev/videoN" a V4L2 capture device (e.g. an HDMI dongle) and "rtsp://..." a network stream.
+    """
+    if source == "camera":
+        return "camera", 0
+    if source.startswith("camera:"):
+        try:
+            return "camera", int(source[len("camera:"):])
+        except ValueError:
+            raise ValueError(f"Invalid camera number in source '{source}'")
+    if source.startswith("file:"):
+        path = source[len("file:"):]
+        if not path:
+            raise ValueError("File source needs a path, e.g. 'file:show.mp4'")
+        return "file", path
+    if source.startswith("v4l2:"):
+        device = source[len("v4l2:"):]
+        if not device:
+            raise ValueError("V4L2 source needs a device, e.g. 'v4l2:/dev/video0'")
+        return "v4l2", device
+    if source.startswith(STREAM_URL_PREFIXES):
+        return "stream", source
+    raise ValueError(f"Unknown source '{source}', expected camera[:N], file:PATH, v4l2:DEVICE or rtsp://URL")
+
+def redact_url(url):
+    """A URL safe to show: its user info, query string and any RTMP stream key replaced by REDACTED.
+
+    Anything that isn't a URL (e.g. "camera" or "file:show.mp4") is returned unchanged.
+    """
+    if not url or "://" not in url:
+        return url
+    parts = urlsplit(url)
+    netloc = parts.netloc
+    if "@" in netloc:
+        netloc = f"{REDACTED}@{netloc.rsplit('@', 1)[1]}"
+    path = parts.path
+    if parts.scheme in ("rtmp", "rtmps"):
+        # rtmp://host/app/key: everything after the application name is the stream key
+        segments = path.split("/", 2)
+        if len(segments) == 3 and segments[2]:
+            path = f"/{segments[1]}/{REDACTED}"
+    return urlunsplit((parts.scheme, netloc, path, REDACTED if parts.query else "", ""))
+
+def remote_config_url(url):
+    """The central configuration server URL for this node, with "{hostname}" filled in"""
+    return url.replace("{hostname}", socket.gethostname())
+
+def fetch_remote_config(url):
+    """Fetch this node's settings from the central configuration server as a JSON object.
+
+    Raises OSError when the server is unreachable or answers with an error, ValueError for
+    anything but a JSON object.
+    """
+    request = urllib.request.Request(remote_config_url(url), headers={"X-Node-Hostname": socket.gethostname()})
+    with urllib.request.urlopen(request, timeout=REMOTE_CONFIG_TIMEOUT) as response:
+        data = json.loads(response.read().decode())
+    if not isinstance(data, dict):
+        raise ValueError("expected a JSON object of settings")
+    return data
+
+@dataclass
+class NodeConfig:
+    """Configuration for a single camera node"""
+    stream_name: Optional[str] = None  # Human-readable stream name, e.g. "Followspot 2 - Tight" (shown as the SDP session name)
+    control_rate: float = 20.0  # Maximum control writes per second sent to the camera
+    control_debounce_ms: int = 20  # Window in which rapid control changes are coalesced
+    control_deadband: Optional[dict] = None  # Smallest change per control that is written, e.g. {"LensPosition": 0.05} (None writes every change)
+    crop_aspect: Optional[str] = None  # Fixed output aspect ratio such as "16:9" (None keeps the sensor aspect)
+    crop_mode: str = "crop"  # "crop" center-crops to crop_aspect, "pad" letterboxes instead
+    bind_address: str = "0.0.0.0"  # Address of the interface to serve on (default: all interfaces)
+    reuse_port: bool = False  # Set SO_REUSEPORT on the listener so a restarted node can bind alongside one shutting down
+    network: str = "dual"  # Address families to serve on all interfaces: "dual", "ipv4" or "ipv6"
+    source: str = "camera"  # Frame source: camera[:N], file:PATH, v4l2:DEVICE or rtsp://URL
+    pixel_formats: Optional[list] = None  # Capture formats to try in order on v4l2 sources, e.g. ["mjpeg", "yuyv422"] (None lets the driver pick)
+    v4l2_input: Optional[int] = None  # Input of a multi-input v4l2 capture card to capture from (None keeps the driver's current input)
+    capture_field: Optional[str] = None  # V4L2 field mode to capture: "none", "interlaced", "top", "bottom" or "alternate" (None keeps the driver's)
+    ev_calibration: Optional[dict] = None  # Camera model (or "default") to the {"exposure_time": us, "analogue_gain": g} that is 0 EV (None works in raw units)
+    initial_controls: Optional[dict] = None  # Controls applied each time the source opens, e.g. {"ExposureTime": 10000, "AnalogueGain": 2.0} (None keeps the startup defaults)
+    ir_cut_control_id: Optional[int] = None  # V4L2 control id of the IR-cut filter, for drivers whose control name doesn't identify it
+    yuyv_conversion: str = "swscale"  # Converter from YUYV capture to the encoders' I420: "swscale" or "numpy" (used only when no scaling is needed)
+    deinterlace: Optional[str] = None  # Deinterlace interlaced sources: "top", "bottom" or "blend" (None leaves frames as captured)
+    undistort: Optional[dict] = None  # Lens calibration to undistort frames with: {"camera_matrix": 3x3, "distortion": [k1, k2, p1, p2, k3]} (None leaves frames as captured)
+    control_sources: Optional[list] = None  # Extra control protocols: "module:ClassName" or {"source": ..., "options": {...}}
+    latency_overlay: bool = False  # Burn the capture wall clock time in ms into every frame, for glass-to-glass latency tests
+    frame_pipeline: Optional[list] = None  # Ordered processor names (None derives it from the enabled features)
+    preset: Optional[str] = None  # Tuning preset applied before the other settings: "low-latency" or "quality"
+    quality_preset: Optional[str] = None  # Encoding preset by use case: "tracking", "preview", "broadcast" or "archive"
+    resolution: tuple = (320, 240)  # Capture resolution (width, height)
+    framerate: int = 30  # Capture frames per second
+    max_pixels_per_second: Optional[int] = None  # Largest width * height * framerate accepted (None uses the board's default, 0 disables the guard)
+    sensor_mode: Optional[int] = None  # Index of the sensor mode to capture from, as listed by --list-devices (None lets libcamera choose)
+    camera_timeout: float = 5.0  # Seconds a frame capture or camera query may block before it is treated as failed
+    max_frame_bytes: Optional[int] = None  # Captured buffers larger than this are dropped unprocessed (None allows twice a full frame at resolution)
+    first_frame_timeout: Optional[float] = 10.0  # Seconds an opened camera has to deliver its first frame before it counts as failed (None waits forever)
+    no_signal_card: bool = False  # Stream a NO SIGNAL card while an opened camera delivers no frames
+    warmup_frames: int = 0  # Frames discarded each time capture starts, while AE/AWB settle
+    buffer_count: int = 6  # Camera buffers; fewer lowers latency, more absorbs processing hiccups
+    frame_queue: bool = True  # Let the camera queue a frame ahead; False always waits for a fresh frame
+    archive_dir: Optional[str] = None  # Directory for the low frame rate archive recording (None disables it)
+    archive_fps: int = 5  # Frames per second kept in the archive
+    archive_segment_seconds: int = 300  # Length of each archive file
+    archive_max_segments: int = 24  # Number of archive files kept before the oldest is deleted
+    archive_codec: str = "libx264"  # Encoder used for the archive
+    archive_bitrate: int = 500000  # Archive encoder bitrate in bits per second
+    publish_url: Optional[str] = None  # rtmp:// or rtsp:// URL of a media server to push the stream to (None disables it)
+    publish_codec: str = "libx264"  # Encoder used for the published stream
+    publish_bitrate: int = 1000000  # Published stream bitrate in bits per second
+    publish_pixel_format: str = "yuv420p"  # Frame layout handed to publish_codec: "yuv420p" (I420) or "nv12" (hardware encoders' native layout)
+    reconnect_initial_delay: float = 5.0  # Seconds before the publisher's first reconnect; doubles with each failed attempt
+    reconnect_max_delay: float = 60.0  # Longest wait between publisher reconnects
+    reconnect_max_attempts: int = 0  # Consecutive failed publisher reconnects before giving up (0 retries forever)
+    mjpeg_fps: int = 10  # Frame rate cap of the /mjpeg preview
+    mjpeg_quality: int = 75  # JPEG quality (1-100) of the /mjpeg preview and /snapshot
+    tracking_size: tuple = (320, 240)  # Size (width, height) of the grayscale /tracking feed for the beacon detector
+    tracking_fps: int = 30  # Frame rate cap of the /tracking feed
+    snapshot_fps: float = 2.0  # Most JPEGs per second encoded for /snapshot, however many clients poll it
+    replay_seconds: Optional[int] = None  # Seconds of recent video kept for GET /replay clips (None disables it)
+    replay_fps: int = 15  # Frames per second kept in the replay buffer
+    replay_bitrate: int = 1000000  # Replay buffer encoder bitrate in bits per second
+    thermal_cap_temperature: Optional[float] = None  # SoC temperature (C) at which streams are capped to thermal_cap_fps (None disables it)
+    thermal_cap_fps: int = 10  # Frame rate streams are capped to while the SoC is hot
+    min_bitrate: Optional[int] = None  # Floor for the session encoders' adaptive bitrate, in bits per second (None lets aiortc decide)
+    bitrate_table: Optional[dict] = None  # Session bitrate cap per streamed size, e.g. {"1280x720": 2000000} (None uses one cap for every size)
+    encoder_threads: Optional[int] = None  # Threads per session H.264 software encoder, at most the CPU count (None lets libx264 pick)
+    insert_aud: bool = False  # Start each H.264 frame sent to sessions with an access unit delimiter NAL
+    abs_capture_time: bool = False  # Offer the abs-capture-time RTP header extension and stamp packets with their frame's capture time
+    parameter_sets: str = "resend"  # On an SPS/PPS change mid-stream: "resend" sends the current sets before every IDR, "passthrough" only logs it
+    target_bitrate: Optional[int] = None  # Bitrate session encoders start at, in bits per second (None uses aiortc's default)
+    drop_policy: str = "drop-oldest"  # What a session's full send queue does with a new frame: "drop-oldest", "drop-newest" or "block"
+    send_queue_frames: int = 1  # Frames each session's send queue holds before drop_policy applies
+    hold_keyframe_interval: Optional[float] = None  # While capture is stalled, resend the held frame as a keyframe this often (seconds, None disables it)
+    idr_interval: Optional[int] = None  # Force a keyframe every this many frames sent to a session, on top of the encoder's own (None disables it)
+    pacing: bool = False  # Spread each frame's RTP packets over time instead of sending them in a burst
+    color_range: str = "limited"  # YUV quantization range captured and signalled: "limited" (16-235) or "full" (0-255)
+    debug_frame_crc: bool = False  # Log a CRC32 of every encoded frame's RTP payloads (debugging only)
+    log_sample_interval: float = 1.0  # Seconds between repeats of the same hot-path error message (0 logs every one)
+    auto_restart: bool = False  # Restart the camera and capture pipeline in-process when it stops delivering frames
+    max_restarts: int = 5  # Automatic restarts allowed within restart_window_seconds before the node exits
+    restart_window_seconds: int = 300  # Window for the max_restarts crash-loop guard
+    metrics_push_url: Optional[str] = None  # statsd://host[:port] to push metrics to (None disables it)
+    metrics_push_interval: float = 10.0  # Seconds between metric pushes
+    metrics_prefix: Optional[str] = None  # Metric name prefix (None uses "followspot.<hostname>")
+    remote_config_url: Optional[str] = None  # Central configuration server URL whose settings override this file; "{hostname}" is replaced by the node's hostname (None disables it)
+    remote_config_interval: float = 60.0  # Seconds between checks of the configuration server for changed settings
+    auth_users: Optional[dict] = None  # Username to password for HTTP basic auth on every endpoint (None disables auth)
+    auth_paths: Optional[dict] = None  # Path prefix to {"users": [...], "realm": ...} limiting who may use it
+    auth_realm: str = "followspot"  # Realm sent in auth challenges for paths whose rule sets none
+    tcp_idle_timeout: Optional[float] = 30.0  # Seconds before a half-open /mjpeg or /events client is dropped (None waits forever)
+    audit_log: Optional[str] = None  # File that receives the connection/session audit log (None disables it)
+    state_file: str = DEFAULT_STATE_PATH  # File the node keeps runtime state in, such as saved control presets
+
+    def validate(self):
+        """Return a list of configuration problems (empty when the config is valid)"""
+        errors = []
+        if self.control_rate <= 0:
+            errors.append("control_rate must be greater than 0")
+        if self.control_debounce_ms < 0:
+            errors.append("control_debounce_ms must not be negative")
+        for control, threshold in (self.control_deadband or {}).items():
+            if isinstance(threshold, bool) or not isinstance(threshold, (int, float)) or threshold < 0:
+                errors.append(f"control_deadband for {control} must be a non-negative number")
+        for entry in self.control_sources or []:
+            try:
+                parse_control_source(entry)
+            except ValueError as e:
+                errors.append(f"control_sources: {e}")
+        if self.crop_aspect is not None:
+            try:
+                parse_aspect(self.crop_aspect)
+            except ValueError as e:
+                errors.append(f"crop_aspect: {e}")
+        if self.crop_mode not in ("crop", "pad"):
+            errors.append("crop_mode must be 'crop' or 'pad'")
+        if self.deinterlace is not None and self.deinterlace not in DEINTERLACE_MODES:
+            errors.append(f"deinterlace must be one of: {', '.join(DEINTERLACE_MODES)}")
+        if self.undistort is not None:
+            try:
+                parse_undistort(self.undistort)
+            except ValueError as e:
+                errors.append(str(e))
+        if self.preset is not None and self.preset not in PRESETS:
+            errors.append(f"preset must be one of: {', '.join(PRESETS)}")
+        if self.quality_preset is not None and self.quality_preset not in QUALITY_PRESETS:
+            errors.append(f"quality_preset must be one of: {', '.join(QUALITY_PRESETS)}")
+        if (len(self.resolution) != 2 or any(not isinstance(v, int) or v <= 0 or v % 2 for v in self.resolution)):
+            errors.append("resolution must be [width, height] with positive even values")
+        if self.framerate <= 0:
+            errors.append("framerate must be greater than 0")
+        errors.extend(self._check_pixel_rate())
+        if self.sensor_mode is not None and self.sensor_mode < 0:
+            errors.append("sensor_mode must not be negative")
+        if self.first_frame_timeout is not None and self.first_frame_timeout <= 0:
+            errors.append("first_frame_timeout must be greater than 0")
+        if self.camera_timeout <= 0:
+            errors.append("camera_timeout must be greater than 0")
+        if self.warmup_frames < 0:
+            errors.append("warmup_frames must not be negative")
+        if self.buffer_count < 1:
+            errors.append("buffer_count must be at least 1")
+        if self.archive_dir is not None:
+            if not 0 < self.archive_fps <= self.framerate:
+                errors.append("archive_fps must be between 1 and framerate")
+            if self.archive_segment_seconds <= 0:
+                errors.append("archive_segment_seconds must be greater than 0")
+            if self.archive_max_segments < 1:
+                errors.append("archive_max_segments must be at least 1")
+        if self.publish_url is not None:
+            try:
+                publish_format(self.publish_url)
+            except ValueError as e:
+                errors.append(f"publish_url: {e}")
+            if self.publish_bitrate <= 0:
+                errors.append("publish_bitrate must be greater than 0")
+        if self.publish_pixel_format not in ENCODER_PIXEL_FORMATS:
+            errors.append(f"publish_pixel_format must be one of: {', '.join(ENCODER_PIXEL_FORMATS)}")
+        if not 0 < self.mjpeg_fps <= self.framerate:
+            errors.append("mjpeg_fps must be between 1 and framerate")
+        if not 1 <= self.mjpeg_quality <= 100:
+            errors.append("mjpeg_quality must be between 1 and 100")
+        if len(self.tracking_size) != 2 or any(not isinstance(v, int) or v <= 0 for v in self.tracking_size):
+            errors.append("tracking_size must be [width, height] with positive values")
+        if not 0 < self.tracking_fps <= self.framerate:
+            errors.append("tracking_fps must be between 1 and framerate")
+        if self.reconnect_initial_delay <= 0:
+            errors.append("reconnect_initial_delay must be greater than 0")
+        if self.reconnect_max_delay < self.reconnect_initial_delay:
+            errors.append("reconnect_max_delay must not be less than reconnect_initial_delay")
+        if self.reconnect_max_attempts < 0:
+            errors.append("reconnect_max_attempts must not be negative (0 retries forever)")
+        if self.snapshot_fps <= 0:
+            errors.append("snapshot_fps must be greater than 0")
+        if self.replay_seconds is not None:
+            if self.replay_seconds <= 0:
+                errors.append("replay_seconds must be greater than 0")
+            if not 0 < self.replay_fps <= self.framerate:
+                errors.append("replay_fps must be between 1 and framerate")
+        if self.log_sample_interval < 0:
+            errors.append("log_sample_interval must not be negative")
+        if self.thermal_cap_temperature is not None and self.thermal_cap_fps <= 0:
+            errors.append("thermal_cap_fps must be greater than 0")
+        for size, bitrate in (self.bitrate_table or {}).items():
+            try:
+                parse_size(size)
+            except ValueError as e:
+                errors.append(f"bitrate_table: {e}")
+            if not isinstance(bitrate, int) or bitrate <= 0:
+                errors.append(f"bitrate_table entry for {size} must be a positive bitrate in bits per second")
+        if self.encoder_threads is not None and not 1 <= self.encoder_threads <= (os.cpu_count() or 1):
+            errors.append(f"encoder_threads must be between 1 and the CPU count ({os.cpu_count() or 1})")
+        if self.min_bitrate is not None and self.min_bitrate <= 0:
+            errors.append("min_bitrate must be greater than 0")
+        if self.target_bitrate is not None:
+            if self.target_bitrate <= 0:
+                errors.append("target_bitrate must be greater than 0")
+            elif self.min_bitrate is not None and self.target_bitrate < self.min_bitrate:
+                errors.append("target_bitrate must not be below min_bitrate")
+        if self.hold_keyframe_interval is not None and self.hold_keyframe_interval <= 0:
+            errors.append("hold_keyframe_interval must be greater than 0")
+        if self.drop_policy not in DROP_POLICIES:
+            errors.append(f"drop_policy must be one of: {', '.join(DROP_POLICIES)}")
+        if self.send_queue_frames < 1:
+            errors.append("send_queue_frames must be at least 1")
+        if self.idr_interval is not None and self.idr_interval < 1:
+            errors.append("idr_interval must be at least 1")
+        errors.extend(self._check_auth())
+        for model, entry in (self.ev_calibration or {}).items():
+            if (not isinstance(entry, dict) or not entry.get("exposure_time", 0) > 0
+                    or not entry.get("analogue_gain", 1.0) > 0):
+                errors.append(f"ev_calibration for '{model}' needs a positive exposure_time (and analogue_gain if given)")
+        if self.tcp_idle_timeout is not None and self.tcp_idle_timeout <= 0:
+            errors.append("tcp_idle_timeout must be greater than 0")
+        if self.max_restarts < 1:
+            errors.append("max_restarts must be at least 1")
+        if self.restart_window_seconds <= 0:
+            errors.append("restart_window_seconds must be greater than 0")
+        if self.metrics_push_url is not None:
+            try:
+                parse_statsd_url(self.metrics_push_url)
+            except ValueError as e:
+                errors.append(f"metrics_push_url: {e}")
+            if self.metrics_push_interval <= 0:
+                errors.append("metrics_push_interval must be greater than 0")
+        if self.remote_config_url is not None:
+            if not self.remote_config_url.startswith(("http://", "https://")):
+                errors.append("remote_config_url must be an http:// or https:// URL")
+            if self.remote_config_interval <= 0:
+                errors.append("remote_config_interval must be greater than 0")
+        if self.color_range not in ("limited", "full"):
+            errors.append("color_range must be 'limited' or 'full'")
+        if self.pixel_formats is not None and (not isinstance(self.pixel_formats, list) or not self.pixel_formats):
+            errors.append("pixel_formats must be a non-empty list of format names")
+        if self.parameter_sets not in PARAMETER_SET_MODES:
+            errors.append(f"parameter_sets must be one of: {', '.join(PARAMETER_SET_MODES)}")
+        if self.max_frame_bytes is not None and len(self.resolution) == 2:
+            frame_bytes = self.resolution[0] * self.resolution[1] * 3 // 2
+            if self.max_frame_bytes < frame_bytes:
+                errors.append(f"max_frame_bytes must be at least one full frame at resolution ({frame_bytes} bytes)")
+        if self.initial_controls is not None and not isinstance(self.initial_controls, dict):
+            errors.append("initial_controls must map control names to values")
+        if self.v4l2_input is not None and self.v4l2_input < 0:
+            errors.append("v4l2_input must not be negative")
+        if self.capture_field is not None and self.capture_field not in CAPTURE_FIELDS:
+            errors.append(f"capture_field must be one of: {', '.join(CAPTURE_FIELDS)}")
+        if self.yuyv_conversion not in YUYV_CONVERTERS:
+            errors.append(f"yuyv_conversion must be one of: {', '.join(YUYV_CONVERTERS)}")
+        if self.network not in ("dual", "ipv4", "ipv6"):
+            errors.append("network must be 'dual', 'ipv4' or 'ipv6'")
+        try:
+            kind, target = parse_source(self.source)
+            if kind == "file" and not os.path.exists(target):
+                errors.append(f"source file '{target}' does not exist")
+        except ValueError as e:
+            errors.append(f"source: {e}")
+        return errors
+
+    def _check_auth(self):
+        """Return problems with the auth_users and auth_paths settings"""
+        errors = []
+        if self.auth_users is not None and not isinstance(self.auth_users, dict):
+            errors.append("auth_users must map usernames to passwords")
+            return errors
+        if self.auth_paths is None:
+            return errors
+        if not self.auth_users:
+            errors.append("auth_paths needs auth_users to be set")
+        for prefix, rule in self.auth_paths.items():
+            if not prefix.startswith("/") or not isinstance(rule, dict):
+                errors.append(f"auth_paths entry '{prefix}' must be a path starting with / mapped to a rule")
+                continue
+            unknown = [user for user in rule.get("users", []) if user not in (self.auth_users or {})]
+            if unknown:
+                errors.append(f"auth_paths entry '{prefix}' names unknown users: {', '.join(unknown)}")
+        return errors
+
+    def _check_pixel_rate(self):
+        """Reject resolution and frame rate combinations the hardware can't encode in real time"""
+        if self.max_pixels_per_second == 0 or len(self.resolution) != 2 or self.framerate <= 0:
+            return []
+        board = read_board_model()
+        limit = self.max_pixels_per_second or default_pixel_rate(board)
+        if limit is None:
+            return []
+
+        width, height = self.resolution
+        rate = width * height * self.framerate
+        if rate <= limit:
+            return []
+
+        suggestions = []
+        max_fps = limit // (width * height)
+        if max_fps >= 1:
+            suggestions.append(f"{width}x{height} at {max_fps} fps")
+        fitting = next((size for size in STANDARD_RESOLUTIONS
+                        if size[0] * size[1] * self.framerate <= limit), None)
+        if fitting:
+            suggestions.append(f"{fitting[0]}x{fitting[1]} at {self.framerate} fps")
+        source = "max_pixels_per_second" if self.max_pixels_per_second else f"the default for {board}"
+        message = (f"{width}x{height} at {self.framerate} fps is {rate / 1e6:.1f}M pixels/s, more than the "
+                   f"{limit / 1e6:.1f}M pixels/s allowed by {source}")
+        if suggestions:
+            message += f"; try {' or '.join(suggestions)}"
+        return [message + " (or raise max_pixels_per_second)"]
+
+def load_node_config(path=DEFAULT_CONFIG_PATH, preset=None, remote_data=None):
+    """Load the node configuration, using defaults when the file does not exist.
+
+    When the file sets remote_config_url, the settings the configuration server returns
+    (remote_data if already fetched) override the file's; if the server can't be reached the
+    file is used alone. A preset (from the argument or the "preset" key) and then the quality
+    preset are applied first so that settings given explicitly still override them.
+    """
+    config = NodeConfig()
+
+    data = {}
+    if os.path.exists(path):
+        with open(path, 'r') as f:
+            data = json.load(f)
+        logger.info(f"Loaded node configuration from {path}")
+    else:
+        logger.info(f"Node configuration {path} not found, using defaults")
+
+    url = data.get("remote_config_url")
+    if url:
+        if remote_data is None:
+            try:
+                remote_data = fetch_remote_config(url)
+                logger.info(f"Loaded node configuration from {remote_config_url(url)}")
+            except (OSError, ValueError) as e:
+                logger.warning(f"Could not fetch node configuration from {remote_config_url(url)}, "
+                               f"using {path} alone: {e}")
+                remote_data = {}
+        # The server can't move the node off itself; that needs the local file
+        data = dict(data, **{key: value for key, value in remote_data.items() if key != "remote_config_url"})
+
+    config.preset = preset or data.get("preset")
+    if config.preset in PRESETS:
+        for key, value in PRESETS[config.preset].items():
+            if key not in data:
+                setattr(config, key, value)
+        derived = ", ".join(f"{key}={getattr(config, key)}" for key in PRESETS[config.preset])
+        logger.info(f"Applied {config.preset} preset: {derived}")
+
+    config.quality_preset = data.get("quality_preset")
+    if config.quality_preset in QUALITY_PRESETS:
+        preset_values = {key: value for key, value in QUALITY_PRESETS[config.quality_preset].items()
+                         if key not in data}
+        for key, value in preset_values.items():
+            setattr(config, key, value)
+        derived = ", ".join(f"{key}={value}" for key, value in preset_values.items())
+        logger.info(f"Applied {config.quality_preset} quality preset: {derived or 'every setting overridden'}")
+
+    known_fields = {field.name for field in fields(NodeConfig)}
+    for key, value in data.items():
+        if key == "preset":
+            continue
+        if key in known_fields:
+            setattr(config, key, value)
+        else:
+            logger.warning(f"Ignoring unknown node configuration key '{key}'")
+
+    return config
@@ -0,0 +1,95 @@
+#!/usr/bin/env python3
+"""
+Parameter Sets
+Watches the SPS/PPS an H.264 encoder emits so a mid-stream change doesn't strand clients.
+"""
+
+import logging
+import time
+
+logger = logging.getLogger("parameter_sets")
+
+# H.264 NAL unit types (ITU-T H.264 table 7-1)
+NAL_IDR = 5
+NAL_SPS = 7
+NAL_PPS = 8
+
+PARAMETER_SET_MODES = ("resend", "passthrough")
+
+def nal_type(unit):
+    return unit[0] & 0x1F if unit else None
+
+def split_annexb(data):
+    """Split an Annex-B byte stream into its NAL units, without the start codes"""
+    # A 4-byte start code leaves its leading zero at the end of the unit before it
+    return [unit.rstrip(b"\x00") for unit in data.split(b"\x00\x00\x01") if unit.rstrip(b"\x00")]
+
+class ParameterSetTracker:
+    """Caches the latest SPS and PPS of one encoder's output and notices when they change.
+
+    An encoder may emit new parameter sets mid-stream, e.g. when it's reconfigured for another
+    bitrate or resolution. A client that missed them (or joined after the first IDR) can't
+    decode what follows, so with resend every IDR is sent with the current SPS and PPS in
+    front of it, inserting the cached ones where the encoder left them out.
+
+    It also follows the GOP: how many frames were sent since the last IDR and whether the last
+    frame was one, which tells a client when joining or requesting a keyframe costs least.
+    """
+
+    def __init__(self, label, resend=True):
+        self.label = label
+        self.resend = resend
+        self.sps = None
+        self.pps = None
+        self.changes = 0
+        self.frames_since_idr = None
+        self.last_idr_at = None
+
+    def process(self, units):
+        """Check one access unit's NAL units, returning (units to send, whether a keyframe is needed).
+
+        A keyframe is needed when the parameter sets changed in an access unit without an IDR,
+        since clients only resync on the next IDR.
+        """
+        changed = False
+        for unit in units:
+            kind = nal_type(unit)
+            if kind not in (NAL_SPS, NAL_PPS):
+                continue
+            cached = self.sps if kind == NAL_SPS else self.pps
+            if cached is not None and unit != cached:
+                changed = True
+                logger.info(f"{'SPS' if kind == NAL_SPS else 'PPS'} changed mid-stream on track {self.label}")
+            if kind == NAL_SPS:
+                self.sps = unit
+            else:
+                self.pps = unit
+        if changed:
+            self.changes += 1
+
+        kinds = [nal_type(unit) for unit in units]
+        if NAL_IDR in kinds:
+            self.frames_since_idr = 0
+            self.last_idr_at = time.time()
+        elif self.frames_since_idr is not None and units:
+            self.frames_since_idr += 1
+        if not self.resend or NAL_IDR not in kinds:
+            return units, changed and self.resend
+
+        missing = [unit for kind, unit in ((NAL_SPS, self.sps), (NAL_PPS, self.pps))
+                   if unit is not None and kind not in kinds]
+        if missing:
+            first_idr = kinds.index(NAL_IDR)
+            units = units[:first_idr] + missing + units[first_idr:]
+        return units, False
+
+    @property
+    def gop_position(self):
+        """Where the stream is in its GOP, or None before the first IDR"""
+        if self.frames_since_idr is None:
+            return None
+        return {
+            "frames_since_idr": self.frames_since_idr,
+            "last_frame_idr": self.frames_since_idr == 0,
+            "last_idr_at": self.last_idr_at,
+        }
@@ -0,0 +1,54 @@
+#!/usr/bin/env python3
+"""
+Pipeline Statistics
+Rolling latency measurements for each stage of the capture-to-network pipeline.
+"""
+
+from collections import Counter, deque
+
+class StageStats:
+    """Rolling window of latency samples for one pipeline stage"""
+
+    def __init__(self, window=300):
+        self.samples = deque(maxlen=window)
+
+    def add(self, seconds):
+        self.samples.append(seconds)
+
+    def summary(self):
+        """Return average, 95th percentile and maximum latency in milliseconds"""
+        if not self.samples:
+            return None
+        ordered = sorted(self.samples)
+        p95 = ordered[min(len(ordered) - 1, int(len(ordered) * 0.95))]
+        return {
+            "avg_ms": round(sum(ordered) / len(ordered) * 1000, 2),
+            "p95_ms": round(p95 * 1000, 2),
+            "max_ms": round(ordered[-1] * 1000, 2),
+            "samples": len(ordered)
+        }
+
+class PipelineStats:
+    """Latency of each pipeline stage, from camera capture to the network"""
+
+    # capture: waiting for the camera to deliver a frame
+    # process: crop and analysis applied to the captured frame
+    # encoder_queue: frame handed to aiortc until its encoder picks it up
+    # encode: time spent in the session's video encoder
+    # network: round trip time reported by the receiver in RTCP
+    # jitter: packet interarrival jitter reported by the receiver in RTCP
+    STAGES = ("capture", "process", "encoder_queue", "encode", "network", "jitter")
+
+    def __init__(self, window=300):
+        self.stages = {name: StageStats(window) for name in self.STAGES}
+        self.counters = Counter()
+
+    def record(self, stage, seconds):
+        self.stages[stage].add(seconds)
+
+    def count(self, name, amount=1):
+        """Increment a named event counter (e.g. dropped frames)"""
+        self.counters[name] += amount
+
+    def latency_summary(self):
+        return {name: stage.summary() for name, stage in self.stages.items()}
@@ -0,0 +1,181 @@
+#!/usr/bin/env python3
+"""
+Replay Buffer
+Keeps the last few seconds of the shared capture, encoded, for instant replay clips.
+"""
+
+import asyncio
+import collections
+import fractions
+import io
+import logging
+import time
+from dataclasses import dataclass
+
+import av
+from av import VideoFrame
+from av.error import FFmpegError
+
+from frame_processing import tag_color_range, i420_size
+
+logger = logging.getLogger("replay_buffer")
+
+# Millisecond timestamps throughout, matching the clip's time base
+TIME_BASE = fractions.Fraction(1, 1000)
+
+@dataclass
+class BufferedPacket:
+    """One encoded frame and when it was captured"""
+    monotonic: float
+    data: bytes
+    keyframe: bool
+
+class ReplayBuffer:
+    """Encodes decimated frames from a FrameHub into a rolling buffer of H.264 packets.
+
+    Packets are kept instead of raw frames so a buffer of several seconds fits in memory.
+    Clips are decoded from the keyframe before the requested start and re-encoded, so they
+    start on exactly the requested frame.
+    """
+
+    def __init__(self, hub, size, seconds=10, fps=15, bitrate=1000000, color_range="limited"):
+        self.hub = hub
+        self.size = size
+        self.seconds = seconds
+        self.fps = fps
+        self.bitrate = bitrate
+        self.color_range = color_range
+        self._packets = collections.deque()
+        self._encoder = None
+
+    async def run(self):
+        loop = asyncio.get_event_loop()
+        interval = 1.0 / self.fps
+        sequence = 0
+        next_due = 0.0
+        logger.info(f"Keeping a {self.seconds}s replay buffer at {self.fps} fps")
+
+        while True:
+            captured = await self.hub.next_frame(sequence)
+            sequence = captured.sequence
+            if captured.monotonic < next_due:
+                continue
+            next_due += interval
+            if next_due <= captured.monotonic:
+                next_due = captured.monotonic + interval
+            try:
+                await loop.run_in_executor(None, self._encode, captured)
+            except FFmpegError as e:
+                logger.error(f"Replay encode failed, restarting the buffer: {e}")
+                self._encoder = None
+                self._packets.clear()
+
+    def _open_encoder(self):
+        encoder = av.CodecContext.create("libx264", "w")
+        encoder.width, encoder.height = self.size
+        encoder.pix_fmt = "yuv420p"
+        encoder.time_base = TIME_BASE
+        encoder.bit_rate = self.bitrate
+        # One keyframe per second bounds how much has to be decoded to reach a clip's start;
+        # zerolatency turns off lookahead so every packet decodes to exactly one frame
+        encoder.options = {"preset": "ultrafast", "tune": "zerolatency", "g": str(self.fps)}
+        return encoder
+
+    def _encode(self, captured):
+        size = i420_size(captured.array)
+        if size != tuple(self.size):
+            # Clips can't mix frame sizes, so replay restarts from the new size
+            logger.info(f"Frame size changed from {self.size[0]}x{self.size[1]} to {size[0]}x{size[1]}, "
+                        f"clearing the replay buffer")
+            self.size = size
+            self._encoder = None
+            self._packets.clear()
+        if self._encoder is None:
+            self._encoder = self._open_encoder()
+
+        frame = VideoFrame.from_ndarray(captured.array, format="yuv420p")
+        tag_color_range(frame, self.color_range)
+        frame.pts = int(captured.monotonic * 1000)
+        frame.time_base = TIME_BASE
+        for packet in self._encoder.encode(frame):
+            self._packets.append(BufferedPacket(captured.monotonic, bytes(packet), packet.is_keyframe))
+        self._trim(captured.monotonic)
+
+    def _trim(self, now):
+        # Drop whole GOPs so the buffer always starts on a keyframe
+        cutoff = now - self.seconds
+        while self._packets:
+            next_key = next((index for index, packet in enumerate(self._packets)
+                             if index > 0 and packet.keyframe), None)
+            if next_key is None or self._packets[next_key].monotonic > cutoff:
+                break
+            for _ in range(next_key):
+                self._packets.popleft()
+
+    @property
+    def available_seconds(self):
+        """Length of replay currently buffered"""
+        if not self._packets:
+            return 0.0
+        return self._packets[-1].monotonic - self._packets[0].monotonic
+
+    def clip(self, offset, duration=None):
+        """Return a fragmented MP4 starting offset seconds before now.
+
+        The clip runs for duration seconds, or up to the newest frame when duration is None.
+        Raises LookupError if nothing is buffered for that range. Blocks while decoding and
+        encoding, so call it from an executor.
+        """
+        packets = list(self._packets)
+        if not packets:
+            raise LookupError("replay buffer is empty")
+
+        start = time.monotonic() - offset
+        end = start + duration if duration is not None else packets[-1].monotonic
+        first = 0
+        for index, packet in enumerate(packets):
+            if packet.keyframe and packet.monotonic <= start:
+                first = index
+        packets = [packet for packet in packets[first:] if packet.monotonic <= end]
+        if not packets or packets[-1].monotonic < start:
+            raise LookupError(f"nothing buffered between {offset}s ago and now")
+
+        output = io.BytesIO()
+        # Fragmented MP4 so players can open the clip without a seekable moov at the end
+        container = av.open(output, mode="w", format="mp4",
+                            options={"movflags": "frag_keyframe+empty_moov+default_base_moof"})
+        stream = container.add_stream("libx264", rate=self.fps)
+        stream.width, stream.height = self.size
+        stream.pix_fmt = "yuv420p"
+        stream.bit_rate = self.bitrate
+        stream.codec_context.time_base = TIME_BASE
+
+        decoder = av.CodecContext.create("h264", "r")
+        clip_start = None
+
+        def write(frames):
+            nonlocal clip_start
+            for frame in frames:
+                # Decoded frames keep the capture time carried on their packet
+                captured_ms = frame.pts
+                # Frames before the requested start only exist to prime the decoder
+                if captured_ms < start * 1000:
+                    continue
+                if clip_start is None:
+                    clip_start = captured_ms
+                frame = frame.reformat(format="yuv420p")
+                frame.pts = captured_ms - clip_start
+                frame.time_base = TIME_BASE
+                for packet in stream.encode(frame):
+                    container.mux(packet)
+
+        for buffered in packets:
+            packet = av.Packet(buffered.data)
+            packet.pts = int(buffered.monotonic * 1000)
+            packet.time_base = TIME_BASE
+            write(decoder.decode(packet))
+        write(decoder.decode(None))
+        for packet in stream.encode(None):
+            container.mux(packet)
+        container.close()
+        return output.getvalue()
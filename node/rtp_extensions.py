@@ -0,0 +1,62 @@
+#!/usr/bin/env python3
+"""
+RTP Extensions
+The abs-capture-time RTP header extension, stamping each packet with when its frame was captured.
+"""
+
+import struct
+
+from aiortc.rtcrtpparameters import RTCRtpHeaderExtensionParameters
+from aiortc.rtp import HeaderExtensionsMap, pack_header_extensions, unpack_header_extensions
+
+from aiortc_hooks import video_header_extensions
+
+ABS_CAPTURE_TIME_URI = "http://www.webrtc.org/experiments/rtp-hdrext/abs-capture-time"
+
+# Seconds from the NTP epoch (1900) to the Unix epoch (1970)
+NTP_EPOCH_OFFSET = 2208988800
+
+def ntp_timestamp(timestamp):
+    """A Unix wall clock time as a 64-bit NTP timestamp (32.32 fixed point seconds since 1900)"""
+    seconds = int(timestamp)
+    fraction = int((timestamp - seconds) * (1 << 32)) & 0xFFFFFFFF
+    return ((seconds + NTP_EPOCH_OFFSET) << 32) | fraction
+
+def advertise_abs_capture_time():
+    """Add abs-capture-time to the video header extensions aiortc negotiates in the SDP.
+
+    aiortc only answers with extensions that are both offered and in its own list, so clients
+    that don't offer it never see it.
+    """
+    extensions = video_header_extensions()
+    if any(extension.uri == ABS_CAPTURE_TIME_URI for extension in extensions):
+        return
+    extensions.append(RTCRtpHeaderExtensionParameters(id=max(extension.id for extension in extensions) + 1,
+                                                      uri=ABS_CAPTURE_TIME_URI))
+
+class CaptureTimeExtensionsMap(HeaderExtensionsMap):
+    """aiortc's header extension map for a sender, adding abs-capture-time to every packet.
+
+    capture_time is the wall clock capture time of the frame being sent, or None to leave the
+    extension out (e.g. for a repeated frame). aiortc sends all of a frame's packets before it
+    encodes the next frame, so setting it at encode time covers exactly that frame's packets.
+    """
+
+    def __init__(self):
+        super().__init__()
+        self.capture_time_id = None
+        self.capture_time = None
+
+    def configure(self, parameters):
+        super().configure(parameters)
+        self.capture_time_id = next((extension.id for extension in parameters.headerExtensions
+                                     if extension.uri == ABS_CAPTURE_TIME_URI), None)
+
+    def set(self, values):
+        profile, value = super().set(values)
+        if self.capture_time_id is None or self.capture_time is None:
+            return profile, value
+        elements = unpack_header_extensions(profile, value) if value else []
+        # The 8-byte form: the capture timestamp without the estimated clock offset
+        elements.append((self.capture_time_id, struct.pack("!Q", ntp_timestamp(self.capture_time))))
+        return pack_header_extensions(elements)
@@ -1,51 +1,586 @@
 import asyncio
+import collections
+import dataclasses
+import errno
 import json
 import logging
+import math
 import os
+import signal
 import socket
+import struct
 import time
+import uuid
+import zlib
 import fractions
+import statistics
+import av
+import cv2
 import numpy as np
 from aiohttp import web
 from av import VideoFrame
 from aiortc import RTCPeerConnection, RTCSessionDescription, MediaStreamTrack
 from aiortc.contrib.media import MediaRelay
-from picamera2 import Picamera2
-from libcamera import controls, Transform
 from aiortc.mediastreams import MediaStreamError
 
+try:
+    from picamera2 import Picamera2
+    from libcamera import controls, Transform, ColorSpace
+except ImportError:
+    # File and stream sources work without the Pi camera stack installed
+    Picamera2 = controls = Transform = ColorSpace = None
+
+from node_config import (NodeConfig, load_node_config, parse_source, fetch_remote_config, remote_config_url,
+                         redact_url, DEFAULT_CONFIG_PATH, DEFAULT_STATE_PATH, URL_SETTINGS, REDACTED)
+from frame_sources import (StreamFrameSource, PlaceholderSource, v4l2_device_name, v4l2_query_capabilities,
+                           v4l2_get_control, v4l2_set_control, v4l2_list_inputs)
+from pipeline_stats import PipelineStats
+from system_health import ThermalMonitor
+from audit_log import AuditLog
+from camera_controls import ControlWriter, clamp_controls, driver_defaults, calibration_for, bounded_ev
+from parameter_sets import ParameterSetTracker, split_annexb, nal_type, NAL_SPS, NAL_PPS
+from latency_test import LatencyOverlayProcessor, measure_pipeline_latency
+from rtp_extensions import CaptureTimeExtensionsMap, advertise_abs_capture_time
+from aiortc_hooks import (check_aiortc, get_sender_encoder, get_sender_ssrc, request_keyframe, reset_sender_encoder,
+                          rtp_loop_exited, sender_packet_count, sender_octet_count, get_header_extensions_map,
+                          set_header_extensions_map, wrap_encode_frame, wrap_send_rtp, wrap_rtcp_handler,
+                          replace_h264_av)
+from media_clock import PtsClock, VIDEO_CLOCK_RATE
+from frame_processing import (aspect_output_size, parse_size, analyze_exposure, placeholder_frame,
+                              black_level, tag_color_range, FrameProcessor, AspectFitProcessor,
+                              DeinterlaceProcessor, UndistortProcessor, FramePipeline, yuyv_to_i420,
+                              yuyv_to_nv12, ENCODER_PIXEL_FORMATS)
+from frame_hub import FrameHub, FrameRateLimiter, IncompleteFrameError
+from archive_recorder import ArchiveRecorder
+from log_sampling import SampledLogger
+from stream_publisher import StreamPublisher
+from replay_buffer import ReplayBuffer
+from mjpeg_streamer import MjpegStreamer, SnapshotCache
+from tracking_feed import TrackingFeed
+from metrics_push import StatsdPusher
+from control_presets import ControlPresetStore
+from control_sources import HttpControlSource, load_control_source, parse_control_source
+from camera_errors import CameraError, FORMAT_UNSUPPORTED, TRANSIENT, classify_camera_error
+from http_auth import PathAuthorizer
+from log_stream import LogStreamHandler
+
 # Configure logging
 logging.basicConfig(level=logging.INFO, format='%(asctime)s - %(name)s - %(levelname)s - %(message)s')
+# Tees every record to GET /logs subscribers
+log_stream = LogStreamHandler()
+logging.getLogger().addHandler(log_stream)
 logger = logging.getLogger("webrtc_server")
+sampled_logger = SampledLogger(logger)
 
 # Global variables
 camera_obj = None
+# Why the camera last failed to open, cleared once it opens
+camera_error = None
+frame_hub = None
+archive_task = None
+publisher = None
+publish_task = None
+replay_buffer = None
+replay_task = None
+mjpeg_streamer = None
+snapshot_cache = None
+tracking_feed = None
+node_config = NodeConfig()
+config_path = DEFAULT_CONFIG_PATH
+config_preset = None
+control_writer = None
 pcs = set()
 relay = MediaRelay()
+# Connected WebRTC sessions by session id
+sessions = {}
 
 active_tracks = set()
 track_lock = asyncio.Lock()
+pipeline_stats = PipelineStats()
+thermal_monitor = ThermalMonitor()
+frame_rate_limiter = FrameRateLimiter([lambda: thermal_monitor.fps_cap])
+audit_log = AuditLog()
+control_presets = ControlPresetStore(DEFAULT_STATE_PATH)
+
+# Capture resolution requested from the camera (set from the node configuration)
+capture_size = (320, 240)
+
+# Lowest bitrate a client may cap its session to (aiortc's VP8 encoder floor)
+MIN_SESSION_BITRATE = 250000
+# How often per-session housekeeping (bitrate cap, stats) runs
+SESSION_MONITOR_INTERVAL = 1.0
+
+# How often captured frames are sampled for exposure analysis
+EXPOSURE_CHECK_INTERVAL = 1.0
+
+# How long a track waits for a new frame before repeating the last one
+FRAME_WAIT_TIMEOUT = 1.0
+
+# Settings that SIGHUP can apply to a running node; anything else needs a restart
+HOT_RELOAD_SETTINGS = {"source", "control_rate", "control_debounce_ms", "control_deadband", "crop_aspect", "crop_mode"}
+
+# Resolution and frame rate combinations tried by --benchmark, smallest first
+BENCHMARK_MODES = [
+    ((320, 240), 30),
+    ((640, 480), 30),
+    ((1280, 720), 30),
+    ((1280, 720), 60),
+    ((1920, 1080), 30),
+]
+# How long each benchmark mode captures and encodes for
+BENCHMARK_SECONDS = 3.0
+# Encoders measured by --benchmark, configured like aiortc's session encoders
+BENCHMARK_ENCODERS = {
+    "vp8": ("libvpx", {"deadline": "realtime", "cpu-used": "4"}),
+    "h264": ("libx264", {"preset": "ultrafast", "tune": "zerolatency"}),
+}
+# Conversions of one frame timed per resolution by --benchmark
+BENCHMARK_CONVERSIONS = 50
+# How long --latency-test captures, processes, encodes and decodes for
+LATENCY_TEST_SECONDS = 10.0
+# Frames encoded per thread count by --benchmark, at BENCHMARK_THREADS_SIZE
+BENCHMARK_THREAD_FRAMES = 30
+BENCHMARK_THREADS_SIZE = (1920, 1080)
+
+# H.264 access unit delimiter NAL (type 9) with primary_pic_type 7 (any slice type)
+ACCESS_UNIT_DELIMITER = b"\x09\xf0"
+
+# Paced sends run at this multiple of the encoder's target bitrate, so pacing smooths bursts
+# without falling behind the encoder
+PACING_HEADROOM = 2.0
+
+# Consecutive failed encodes after which a session's encoder is replaced
+ENCODER_REINIT_ERRORS = 3
+
+# FFmpeg encoder name endings of hardware encoders (Pi V4L2 M2M, legacy OMX and desktop GPUs)
+HARDWARE_ENCODER_SUFFIXES = ("_v4l2m2m", "_omx", "_vaapi", "_nvenc")
+
+# How long POST /keyframe waits for the encoders to emit the requested keyframes
+KEYFRAME_REQUEST_TIMEOUT = 2.0
+
+# A session whose last RTCP receiver report is older than this is no longer counted as receiving;
+# browsers report about once a second
+RECEIVER_REPORT_TIMEOUT = 5.0
+
+# Seconds of receiver reports the per-session loss rate is estimated over
+LOSS_WINDOW = 10.0
+
+# Data channel label a client opens to receive per-frame capture metadata
+FRAME_METADATA_CHANNEL = "frame-metadata"
+# Per-frame metadata record: sequence (uint32), capture wall clock time in ns (int64), RTP timestamp (uint32)
+FRAME_METADATA_FORMAT = "!IqI"
+
+# Poll interval for publishing the lens position while autofocus is running
+FOCUS_POLL_INTERVAL = 0.5
+
+# Fixed exposure for IR beacon tracking: short, low gain and no white balance so only the
+# beacons stay bright
+IR_MODE_CONTROLS = {
+    "AeEnable": False,
+    "AwbEnable": False,
+    "ExposureTime": 5000,
+    "AnalogueGain": 1.0,
+    "ColourGains": (1.0, 1.0),
+}
+
+# Control names that identify an IR-cut filter, compared lowercase with everything but letters removed
+IR_CUT_CONTROL_NAMES = ("ircut", "ircutfilter", "irfilter", "infraredcut", "daynight", "daynightmode")
+
+# Controls saved in a control preset: the look of the image, not the capture format
+PRESET_CONTROLS = ("AeEnable", "ExposureTime", "AnalogueGain", "AwbEnable", "ColourGains",
+                   "AfMode", "LensPosition")
+
+# Set once the port is bound and the first frame has been captured
+node_ready = False
+# Capture pipeline state reported on /healthz: "starting", "running", "restarting" or "failed"
+pipeline_state = "starting"
+# When the supervisor restarted the pipeline, for the restart rate guard
+restart_times = collections.deque()
+# Set to stop the server (e.g. when the supervisor gives up)
+server_stop = None
+
+# How often the supervisor checks the capture pipeline
+SUPERVISOR_INTERVAL = 2.0
+# How long the pipeline may go without a frame before the supervisor restarts it
+PIPELINE_STALL_TIMEOUT = 10.0
+
+# While set the camera stays closed and clients receive a maintenance card instead
+maintenance_mode = False
+# Set by --verbose: debug logging and a pipeline summary once the node is ready
+verbose = False
+MAINTENANCE_LINES = ["CAMERA OFFLINE - MAINTENANCE"]
+# Card streamed, with no_signal_card set, while an opened camera isn't delivering frames
+NO_SIGNAL_LINES = ["NO SIGNAL"]
+
+# Controls captured before IR mode is enabled so disabling it restores them (None when IR mode is off)
+ir_snapshot = None
+
+def control_gauge_values(control, value):
+    """Numeric gauges for one control value: booleans and modes as 0/1, pairs split per channel"""
+    if control == "AfMode":
+        return {"AfMode_auto": 1 if value == "auto" else 0}
+    if isinstance(value, bool):
+        return {control: int(value)}
+    if isinstance(value, (int, float)):
+        return {control: value}
+    if control == "ColourGains" and isinstance(value, (tuple, list)) and len(value) == 2:
+        return {"ColourGains_red": value[0], "ColourGains_blue": value[1]}
+    return {}
+
+class ControlEventBus:
+    """Fan-out of camera control changes to interested subscribers (e.g. the operator UI).
+
+    Numeric control values are also kept as gauges for /metrics and the StatsD push.
+    """
+
+    def __init__(self, max_queue=100):
+        self._subscribers = set()
+        self._max_queue = max_queue
+        self._loop = None
+        self.last_values = {}
+        self.gauges = {}
+
+    def subscribe(self):
+        self._loop = asyncio.get_running_loop()
+        queue = asyncio.Queue(maxsize=self._max_queue)
+        self._subscribers.add(queue)
+        return queue
+
+    def unsubscribe(self, queue):
+        self._subscribers.discard(queue)
+
+    def publish(self, control, value):
+        """Record the new value of a control and notify all subscribers"""
+        self.last_values[control] = value
+        self.gauges.update(control_gauge_values(control, value))
+        event = {"control": control, "value": value, "timestamp": time.time()}
+        try:
+            asyncio.get_running_loop()
+        except RuntimeError:
+            # Called from a worker thread (e.g. camera setup in an executor)
+            if self._loop is not None:
+                self._loop.call_soon_threadsafe(self._deliver, event)
+            return
+        self._deliver(event)
+
+    def _deliver(self, event):
+        for queue in list(self._subscribers):
+            try:
+                queue.put_nowait(event)
+            except asyncio.QueueFull:
+                # A slow subscriber only loses its oldest event, never blocks the camera
+                try:
+                    queue.get_nowait()
+                    queue.put_nowait(event)
+                except (asyncio.QueueEmpty, asyncio.QueueFull):
+                    pass
+
+control_events = ControlEventBus()
+
+class ExposureMonitor:
+    """Tracks the exposure health of the captured image"""
+
+    def __init__(self, interval=EXPOSURE_CHECK_INTERVAL):
+        self.interval = interval
+        self.health = {"status": "unknown"}
+        self._last_check = 0.0
+
+    def check(self, frame):
+        """Analyze a frame if the check interval has elapsed"""
+        now = time.monotonic()
+        if now - self._last_check < self.interval:
+            return
+        self._last_check = now
+        
+        previous = self.health.get("status")
+        self.health = analyze_exposure(frame)
+        status = self.health["status"]
+        if status == previous:
+            return
+        
+        if status == "ok":
+            logger.info(f"Exposure back to normal (mean luma {self.health['mean_luma']})")
+        elif status == "clipping" and control_events.last_values.get("AeEnable") is False:
+            logger.warning(f"Image is clipping with auto exposure off "
+                           f"({self.health['clipped_highlights']:.1%} highlights clipped) - reduce exposure or gain")
+        else:
+            logger.warning(f"Exposure health is {status} (mean luma {self.health['mean_luma']})")
+
+exposure_monitor = ExposureMonitor()
+
+class ExposureProcessor(FrameProcessor):
+    """Feeds frames to the exposure monitor without modifying them"""
+
+    name = "exposure"
 
-def get_ip_address():
+    def process(self, frame):
+        exposure_monitor.check(frame)
+        return frame
+
+# Processor factories by name, in the default pipeline order
+PROCESSOR_FACTORIES = {
+    "deinterlace": lambda: DeinterlaceProcessor(node_config.deinterlace),
+    "undistort": lambda: UndistortProcessor(node_config.undistort),
+    "aspect": lambda: AspectFitProcessor(node_config.crop_aspect, node_config.crop_mode,
+                                         black_level(node_config.color_range)),
+    "exposure": ExposureProcessor,
+    "latency": lambda: LatencyOverlayProcessor(black_level(node_config.color_range)),
+}
+
+def default_pipeline_names():
+    """Processor names enabled by the node configuration"""
+    names = []
+    if node_config.deinterlace:
+        names.append("deinterlace")
+    if node_config.undistort:
+        names.append("undistort")
+    if node_config.crop_aspect:
+        names.append("aspect")
+    names.append("exposure")
+    if node_config.latency_overlay:
+        # Last, so the stamp is neither cropped nor counted in the exposure health
+        names.append("latency")
+    return names
+
+def build_frame_pipeline():
+    """Build the frame pipeline from the node configuration.
+
+    Raises ValueError for unknown processor names or processors that cannot be configured.
+    """
+    names = node_config.frame_pipeline
+    if names is None:
+        names = default_pipeline_names()
+    
+    processors = []
+    for name in names:
+        if name not in PROCESSOR_FACTORIES:
+            raise ValueError(f"Unknown frame processor '{name}' (available: {', '.join(PROCESSOR_FACTORIES)})")
+        try:
+            processors.append(PROCESSOR_FACTORIES[name]())
+        except (TypeError, ValueError) as e:
+            raise ValueError(f"Cannot configure frame processor '{name}': {e}")
+    return FramePipeline(processors)
+
+frame_pipeline = FramePipeline()
+
+def get_ip_address(family=socket.AF_INET):
     """Get the server's local IP address"""
-    s = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+    s = socket.socket(family, socket.SOCK_DGRAM)
     try:
         # This doesn't need to be reachable
-        s.connect(('10.255.255.255', 1))
+        s.connect(('2001:db8::1', 1) if family == socket.AF_INET6 else ('10.255.255.255', 1))
         IP = s.getsockname()[0]
     except Exception:
-        IP = '127.0.0.1'
+        IP = '::1' if family == socket.AF_INET6 else '127.0.0.1'
     finally:
         s.close()
     return IP
 
-def init_picamera():
+def format_address(host, port):
+    """Format a host and port, bracketing IPv6 addresses"""
+    if ":" in host:
+        return f"[{host}]:{port}"
+    return f"{host}:{port}"
+
+def resolve_bind_host(address, network):
+    """Return the host to bind for the configured address and network family.
+
+    None binds every interface on both IPv4 and IPv6.
+    """
+    if address not in ("", "0.0.0.0", "::"):
+        return address
+    return {"dual": None, "ipv4": "0.0.0.0", "ipv6": "::"}[network]
+
+def check_bind(host, port, reuse_port=False):
+    """Raise OSError if the port cannot be bound on every address the server would listen on"""
+    hosts = ["0.0.0.0", "::"] if host is None else [host]
+    for bind_host in hosts:
+        for family, socktype, proto, _, sockaddr in socket.getaddrinfo(bind_host, port, type=socket.SOCK_STREAM):
+            with socket.socket(family, socktype, proto) as sock:
+                sock.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+                if reuse_port:
+                    sock.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEPORT, 1)
+                if family == socket.AF_INET6:
+                    sock.setsockopt(socket.IPPROTO_IPV6, socket.IPV6_V6ONLY, 1)
+                sock.bind(sockaddr)
+
+def find_listener(host, port):
+    """Return True if something already accepts connections on the port the server would use"""
+    probe_hosts = ["127.0.0.1", "::1"] if host in (None, "0.0.0.0", "::") else [host]
+    for probe_host in probe_hosts:
+        try:
+            with socket.create_connection((probe_host, port), timeout=1.0):
+                return True
+        except OSError:
+            continue
+    return False
+
+def describe_bind_failure(host, port, error):
+    """Explain why the listener couldn't bind, telling a live server apart from a lingering socket"""
+    bind_desc = format_address(host or "*", port)
+    if error.errno != errno.EADDRINUSE:
+        return f"Cannot bind {bind_desc}: {error}"
+    if find_listener(host, port):
+        return f"Cannot bind {bind_desc}: another process is already serving on this port"
+    return (f"Cannot bind {bind_desc}: the port is held by a socket that isn't accepting connections, "
+            f"e.g. one still closing from a previous run")
+
+def sd_notify(state):
+    """Send a state update to systemd when running as a Type=notify service"""
+    address = os.environ.get("NOTIFY_SOCKET")
+    if not address:
+        return
+    if address.startswith("@"):
+        # Abstract namespace socket
+        address = "\0" + address[1:]
+    try:
+        with socket.socket(socket.AF_UNIX, socket.SOCK_DGRAM) as sock:
+            sock.sendto(state.encode(), address)
+    except OSError as e:
+        logger.warning(f"Could not notify systemd: {e}")
+
+async def announce_ready(url):
+    """Mark the node ready once the camera delivers its first frame.
+
+    Prints a single READY line on stdout for launch scripts and notifies systemd.
+    """
+    global node_ready, pipeline_state
+    captured = await frame_hub.next_frame()
+    # Frames of the NO SIGNAL card don't make the node ready
+    while pipeline_state == "no-signal":
+        captured = await frame_hub.next_frame(captured.sequence)
+    node_ready = True
+    pipeline_state = "running"
+    width, height = get_output_size()
+    print(f"READY url={url} size={width}x{height} first_frame={captured.sequence}", flush=True)
+    sd_notify("READY=1")
+    logger.info("Node ready to serve")
+    if verbose:
+        # Give the frame rate a moment to settle before measuring it
+        await asyncio.sleep(2.0)
+        for line in format_pipeline_banner(pipeline_report()):
+            logger.info(line)
+
+def init_camera():
+    """Open the configured frame source (the Pi camera unless a file or stream is configured)"""
+    if maintenance_mode:
+        return init_placeholder()
+    kind, target = parse_source(node_config.source)
+    if kind == "camera":
+        return init_picamera(target)
+    return init_stream_source(target, "v4l2" if kind == "v4l2" else None)
+
+def init_placeholder(lines=MAINTENANCE_LINES):
+    """Stream a card, the maintenance card unless other lines are given, without opening the camera"""
+    global camera_obj, control_writer
+    
+    if lines is MAINTENANCE_LINES:
+        logger.info("Maintenance mode: the camera stays closed, streaming a placeholder")
+    frame = placeholder_frame(capture_size[0], capture_size[1], lines,
+                              black_level(node_config.color_range))
+    camera_obj = PlaceholderSource(frame, fps=node_config.framerate)
+    camera_obj.start()
+    control_writer = ControlWriter(camera_obj,
+                                   max_rate=node_config.control_rate,
+                                   debounce=node_config.control_debounce_ms / 1000.0,
+                                   deadband=node_config.control_deadband)
+    return camera_obj
+
+def on_input_change(input_format):
+    """The source's own resolution changed; frames are rescaled, but decoders need a fresh keyframe"""
+    request_keyframes()
+
+def init_stream_source(url, input_format=None):
+    """Open a video file, network stream or V4L2 capture device in place of the camera"""
+    global camera_obj, control_writer, camera_error
+    
+    try:
+        logger.info(f"Using {url} as the frame source instead of the camera")
+        camera_obj = StreamFrameSource(url, capture_size, input_format, node_config.pixel_formats,
+                                       node_config.yuyv_conversion, node_config.v4l2_input,
+                                       node_config.capture_field)
+        camera_obj.on_source_change = on_input_change
+        camera_obj.start()
+        apply_initial_controls()
+        control_writer = ControlWriter(camera_obj,
+                                       max_rate=node_config.control_rate,
+                                       debounce=node_config.control_debounce_ms / 1000.0,
+                                       deadband=node_config.control_deadband)
+        camera_error = None
+        return camera_obj
+    except Exception as e:
+        camera_error = classify_camera_error(e, url if input_format == "v4l2" else None)
+        logger.error(f"Could not open source {url} ({camera_error.category}): {e}")
+        if camera_error.hint:
+            logger.error(camera_error.hint)
+        return None
+
+def apply_initial_controls():
+    """Apply initial_controls to the source just opened, so every start gives the same image.
+
+    Pi cameras take libcamera control names; v4l2: sources take the driver's control names
+    or numeric ids. Controls the source doesn't have are logged and skipped.
+    """
+    values = node_config.initial_controls
+    if not values or isinstance(camera_obj, PlaceholderSource):
+        return
+    if isinstance(camera_obj, StreamFrameSource):
+        if camera_obj.input_format != "v4l2":
+            logger.warning(f"initial_controls ignored: {camera_obj.url} has no controls")
+            return
+        apply_initial_v4l2_controls(values)
+        return
+    
+    requested = {}
+    for name, value in values.items():
+        if name not in camera_obj.camera_controls:
+            logger.warning(f"Initial control {name} skipped: the camera has no such control")
+            continue
+        if name == "AfMode" and isinstance(value, str):
+            value = controls.AfModeEnum.Continuous if value == "auto" else controls.AfModeEnum.Manual
+        requested[name] = tuple(value) if isinstance(value, list) else value
+    applied, clamped = clamp_controls(requested, camera_obj.camera_controls)
+    for name, value, new_value in clamped:
+        logger.warning(f"Clamped initial control {name} from {value} to {new_value} (outside the camera's range)")
+    camera_obj.set_controls(applied)
+    for name, value in applied.items():
+        if name == "AfMode":
+            value = "auto" if value == controls.AfModeEnum.Continuous else "manual"
+        control_events.publish(name, value)
+    logger.info(f"Applied initial controls: {', '.join(f'{name}={value}' for name, value in applied.items())}")
+
+def apply_initial_v4l2_controls(values):
+    """Write initial_controls to a V4L2 device by control name (case-insensitive) or id"""
+    descriptors = {name.lower(): descriptor for name, descriptor in camera_obj.control_descriptors.items()}
+    applied = []
+    for name, value in values.items():
+        key = str(name).lower()
+        if key in descriptors:
+            control_id = descriptors[key]["id"]
+        elif key.startswith("0x") or key.isdigit():
+            control_id = int(key, 0)
+        else:
+            logger.warning(f"Initial control {name} skipped: {camera_obj.url} has no such control")
+            continue
+        try:
+            v4l2_set_control(camera_obj.url, control_id, int(value))
+            applied.append(f"{name}={value}")
+        except (OSError, TypeError, ValueError) as e:
+            logger.warning(f"Could not apply initial control {name}={value}: {e}")
+    if applied:
+        logger.info(f"Applied initial controls on {camera_obj.url}: {', '.join(applied)}")
+
+def init_picamera(camera_num=0):
     """Initialize the Raspberry Pi camera with optimized settings for Camera Module 3"""
-    global camera_obj
+    global camera_obj, control_writer, camera_error
+    
+    if Picamera2 is None:
+        logger.error("picamera2 is not installed; install it or configure a file/stream source")
+        return None
     
     try:
         logger.info("Initializing Camera Module 3 with libcamera...")
-        camera_obj = Picamera2()
+        camera_obj = Picamera2(camera_num)
         
         # Get camera info
         camera_info = camera_obj.camera_properties
@@ -54,20 +589,37 @@ def init_picamera():
         # Allow camera to warm up and stabilize
         time.sleep(1)
         
-        # Use more conservative settings for better stability
-        # - Lower resolution (320x240 instead of 640x480)
-        # - Lower framerate (30 fps instead of 60 fps)
+        # Resolution and framerate come from the node config (default 320x240 @ 30fps for stability)
         # - Use YUV420 format which may be more efficient
+        # - Fewer buffers and no frame queue trade throughput for latency
+        # - sYCC is full range; leaving the colour space unset keeps libcamera's limited-range default
+        frame_duration = int(1000000 / node_config.framerate)
+        sensor = None
+        if node_config.sensor_mode is not None:
+            modes = camera_obj.sensor_modes
+            if node_config.sensor_mode >= len(modes):
+                raise CameraError(FORMAT_UNSUPPORTED, f"sensor_mode {node_config.sensor_mode} does not exist, "
+                                                      f"this sensor has {len(modes)} modes (see --list-devices)")
+            mode = modes[node_config.sensor_mode]
+            sensor = {"output_size": mode["size"], "bit_depth": mode["bit_depth"]}
+            logger.info(f"Using sensor mode {node_config.sensor_mode}: {format_sensor_mode(mode)}")
+            if node_config.framerate > mode.get("fps", node_config.framerate):
+                logger.warning(f"framerate {node_config.framerate} is above sensor mode "
+                               f"{node_config.sensor_mode}'s maximum of {mode['fps']:.1f} fps")
         config = camera_obj.create_video_configuration(
-            main={"size": (320, 240), "format": "YUV420"},        ## Modified Resolution
-            lores={"size": (320, 240)},  # Add a lower resolution stream for processing
+            main={"size": capture_size, "format": "YUV420"},
+            lores={"size": (min(320, capture_size[0]), min(240, capture_size[1]))},  # Lower resolution stream for processing
+            buffer_count=node_config.buffer_count,
+            queue=node_config.frame_queue,
             controls={
-                "FrameRate": 30,
+                "FrameRate": node_config.framerate,
                 "AwbEnable": True,  # Enable auto white balance
                 "NoiseReductionMode": controls.draft.NoiseReductionModeEnum.Fast,  # Faster noise reduction
-                "FrameDurationLimits": (33333, 33333)  # Force exactly 30fps (1/30 = 33333μs)
+                "FrameDurationLimits": (frame_duration, frame_duration)  # Force the exact framerate
             },
-            transform=Transform(hflip=0, vflip=0)
+            transform=Transform(hflip=0, vflip=0),
+            colour_space=ColorSpace.Sycc() if node_config.color_range == "full" else None,
+            sensor=sensor
         )
         
         # Apply configuration
@@ -80,6 +632,12 @@ def init_picamera():
             "ExposureTime": 20000,  # 20ms exposure time (reasonable default)
             "ColourGains": (1.0, 1.0)  # Neutral color balance (red, blue)
         })
+        control_events.publish("AfMode", "auto")
+        # A fixed ExposureTime takes exposure out of libcamera's AE loop
+        control_events.publish("AeEnable", False)
+        control_events.publish("AwbEnable", True)
+        control_events.publish("IrMode", False)
+        apply_initial_controls()
         
         # Start the camera with a longer timeout
         camera_obj.start()
@@ -87,27 +645,633 @@ def init_picamera():
         # Allow camera to initialize fully
         time.sleep(2)
         
-        logger.info(f"Camera initialized and started (320x240 @ 30fps, using libcamera)")
+        # All runtime control changes go through the writer so the driver sees a bounded rate
+        control_writer = ControlWriter(camera_obj,
+                                       max_rate=node_config.control_rate,
+                                       debounce=node_config.control_debounce_ms / 1000.0,
+                                       deadband=node_config.control_deadband)
+        
+        output_w, output_h = get_output_size()
+        logger.info(f"Camera initialized and started ({capture_size[0]}x{capture_size[1]} @ {node_config.framerate}fps, using libcamera)")
+        if (output_w, output_h) != capture_size:
+            logger.info(f"Streaming at {output_w}x{output_h} ({node_config.crop_mode} to {node_config.crop_aspect})")
+        camera_error = None
         return camera_obj
     except Exception as e:
-        logger.error(f"Camera initialization failed: {e}")
+        camera_error = classify_camera_error(e)
+        logger.error(f"Camera initialization failed ({camera_error.category}): {e}")
+        if camera_error.hint:
+            logger.error(camera_error.hint)
+        return None
+
+class CameraTimeoutError(Exception):
+    """Raised when a blocking camera call doesn't return within camera_timeout"""
+
+async def camera_call(func, *args):
+    """Run a blocking camera call in an executor, giving up after camera_timeout.
+
+    A stuck driver then fails the caller (e.g. an HTTP handler) instead of hanging it. The call
+    itself can't be interrupted and keeps its executor thread until the driver returns.
+    """
+    loop = asyncio.get_event_loop()
+    try:
+        return await asyncio.wait_for(loop.run_in_executor(None, func, *args), node_config.camera_timeout)
+    except asyncio.TimeoutError:
+        raise CameraTimeoutError(f"camera did not respond within {node_config.camera_timeout}s")
+
+def get_output_size():
+    """Return the (width, height) of streamed frames after any aspect crop"""
+    if not node_config.crop_aspect:
+        return capture_size
+    return aspect_output_size(capture_size[0], capture_size[1], node_config.crop_aspect, node_config.crop_mode)
+
+def get_focus_range():
+    """Return the (min, max, step) lens position range in dioptres.
+
+    libcamera reports a continuous range, so step is None when the driver has no step.
+    """
+    if not camera_obj or "LensPosition" not in camera_obj.camera_controls:
+        return None
+    limits = camera_obj.camera_controls["LensPosition"]
+    return float(limits[0]), float(limits[1]), None
+
+def has_autofocus():
+    """Whether the source has libcamera's AfMode control, which only a Pi camera with a focus motor does"""
+    return controls is not None and camera_obj is not None and "AfMode" in camera_obj.camera_controls
+
+def set_focus_absolute(position):
+    """Switch to manual focus and move the lens to an absolute position in dioptres"""
+    if not has_autofocus():
+        raise LookupError("autofocus needs the Pi camera")
+    focus_range = get_focus_range()
+    if focus_range is None:
+        raise ValueError("Camera does not support lens position control")
+    position = min(focus_range[1], max(focus_range[0], float(position)))
+    # The deadband may keep the previous position, which is what gets published and returned
+    return http_controls.submit({
+        "AfMode": controls.AfModeEnum.Manual,
+        "LensPosition": position
+    })["LensPosition"]
+
+def submit_controls(values):
+    """Queue control values in the ControlWriter and announce the ones that will be written on /events"""
+    if camera_obj is not None:
+        # Only what the source takes is written, so only that is reported as applied
+        values = {name: value for name, value in values.items() if name in camera_obj.camera_controls}
+    applied = control_writer.submit(values)
+    for name, value in applied.items():
+        if name == "AfMode":
+            value = "auto" if value == controls.AfModeEnum.Continuous else "manual"
+        control_events.publish(name, value)
+    return applied
+
+def controls_unavailable():
+    """A 409 response when the source takes no control writes (files, streams, the placeholder), else None"""
+    if camera_obj.camera_controls:
+        return None
+    return web.Response(status=409, text=f"{camera_obj.camera_properties.get('Model')} has no writable controls")
+
+# The HTTP API is the built-in control source; others come from control_sources in the config
+http_controls = HttpControlSource(submit_controls)
+control_sources = [http_controls]
+
+def build_control_sources():
+    """Build the HTTP source plus every source in the node configuration.
+
+    Raises ValueError for sources that can't be loaded or configured.
+    """
+    sources = [http_controls]
+    for entry in node_config.control_sources or []:
+        spec, options = parse_control_source(entry)
+        source_class = load_control_source(spec)
+        if source_class is HttpControlSource:
+            continue
+        try:
+            sources.append(source_class(submit_controls, **options))
+        except (TypeError, ValueError) as e:
+            raise ValueError(f"Cannot configure control source '{spec}': {e}")
+    return sources
+
+def set_autofocus(enabled):
+    """Toggle continuous autofocus"""
+    if not has_autofocus():
+        raise LookupError("autofocus needs the Pi camera")
+    mode = controls.AfModeEnum.Continuous if enabled else controls.AfModeEnum.Manual
+    http_controls.submit({"AfMode": mode})
+
+def reset_controls():
+    """Write every control's driver default, the software equivalent of a factory reset.
+
+    In IR mode the IR exposure is applied on top of the defaults so the node keeps tracking, and
+    leaving IR mode still restores the controls saved when it was enabled.
+    """
+    defaults = driver_defaults(camera_obj.camera_controls)
+    if ir_snapshot is not None:
+        defaults = {name: value for name, value in defaults.items() if name not in IR_MODE_CONTROLS}
+        defaults.update(IR_MODE_CONTROLS)
+    defaults = http_controls.submit(defaults)
+    
+    logger.info(f"Reset {len(defaults)} controls to driver defaults{' in IR mode' if ir_snapshot is not None else ''}")
+    return defaults
+
+def enable_ir_mode():
+    """Switch to fixed IR tracking exposure, remembering the current controls first.
+
+    Blocks on a metadata capture, so call it from an executor.
+    """
+    global ir_snapshot
+    if ir_snapshot is not None:
+        return {name: control_events.last_values.get(name) for name in IR_MODE_CONTROLS}
+    
+    snapshot = snapshot_controls(IR_MODE_CONTROLS)
+    ir_snapshot = snapshot
+    
+    applied = http_controls.submit(dict(IR_MODE_CONTROLS))
+    control_events.publish("IrMode", True)
+    logger.info(f"IR mode enabled, saved {sorted(snapshot)}")
+    return applied
+
+def disable_ir_mode():
+    """Leave IR mode, restoring the controls saved when it was enabled"""
+    global ir_snapshot
+    if ir_snapshot is None:
+        return {}
+    
+    snapshot, ir_snapshot = ir_snapshot, None
+    restored = restore_controls(snapshot)
+    control_events.publish("IrMode", False)
+    logger.info(f"IR mode disabled, restored {sorted(restored)}")
+    return restored
+
+def find_ir_cut_control():
+    """Return the (device, control id) that drives the source's IR-cut filter.
+
+    Drivers name the control differently, so it is found by name, falling back to the
+    configured ir_cut_control_id. Raises LookupError when the source has none.
+    """
+    kind, device = parse_source(node_config.source)
+    if kind != "v4l2":
+        raise LookupError("the IR-cut filter can only be driven on v4l2: sources")
+    for name, descriptor in camera_obj.control_descriptors.items():
+        if "".join(filter(str.isalpha, name.lower())) in IR_CUT_CONTROL_NAMES:
+            return device, descriptor["id"]
+    if node_config.ir_cut_control_id is not None:
+        return device, node_config.ir_cut_control_id
+    raise LookupError(f"{device} has no IR-cut control (set ir_cut_control_id if it uses an unnamed one)")
+
+def set_ir_cut_filter(enabled):
+    """Move the IR-cut filter in (day) or out (night), leaving exposure alone.
+
+    Blocks on device ioctls, so call it from an executor.
+    """
+    device, control_id = find_ir_cut_control()
+    v4l2_set_control(device, control_id, 1 if enabled else 0)
+    control_events.publish("IrCutFilter", enabled)
+    logger.info(f"IR-cut filter {'in' if enabled else 'out'} ({device} control {control_id:#x})")
+
+def get_ir_cut_filter():
+    """Whether the IR-cut filter is in. Blocks on device ioctls, so call it from an executor."""
+    device, control_id = find_ir_cut_control()
+    return bool(v4l2_get_control(device, control_id))
+
+def restore_controls(snapshot):
+    """Write back controls saved by snapshot_controls, returning the values applied"""
+    restored = {}
+    # Hand exposure and white balance back to the auto loops if they were running,
+    # otherwise put back the fixed values
+    if snapshot.get("AeEnable", True):
+        restored["AeEnable"] = True
+    else:
+        restored.update({name: snapshot[name] for name in ("ExposureTime", "AnalogueGain") if name in snapshot})
+        restored["AeEnable"] = False
+    if snapshot.get("AwbEnable", True):
+        restored["AwbEnable"] = True
+    else:
+        if "ColourGains" in snapshot:
+            # Presets come back from JSON with the gains as a list
+            restored["ColourGains"] = tuple(snapshot["ColourGains"])
+        restored["AwbEnable"] = False
+    # Presets saved on a Pi camera can be recalled on other sources, less the focus
+    if has_autofocus() and snapshot.get("AfMode") == "auto":
+        restored["AfMode"] = controls.AfModeEnum.Continuous
+    elif has_autofocus() and snapshot.get("AfMode") == "manual":
+        restored["AfMode"] = controls.AfModeEnum.Manual
+        if "LensPosition" in snapshot:
+            restored["LensPosition"] = snapshot["LensPosition"]
+    
+    return http_controls.submit(restored)
+
+def snapshot_controls(names):
+    """Current values of the named controls.
+
+    Blocks on a metadata capture, so call it from an executor.
+    """
+    metadata = camera_obj.capture_metadata()
+    snapshot = {}
+    for name in names:
+        # Metadata has the values the auto loops actually settled on
+        value = metadata.get(name, control_events.last_values.get(name))
+        if name == "AfMode":
+            # Metadata reports AfState rather than the mode, so use the last mode set
+            value = control_events.last_values.get(name)
+        if value is not None:
+            snapshot[name] = value
+    return snapshot
+
+async def focus_monitor():
+    """Publish lens position changes while autofocus is moving the lens"""
+    loop = asyncio.get_event_loop()
+    while True:
+        await asyncio.sleep(FOCUS_POLL_INTERVAL)
+        if not camera_obj or control_events.last_values.get("AfMode") != "auto":
+            continue
+        try:
+            metadata = await camera_call(camera_obj.capture_metadata)
+        except Exception as e:
+            logger.debug(f"Could not read focus metadata: {e}")
+            continue
+        position = metadata.get("LensPosition")
+        last = control_events.last_values.get("LensPosition")
+        if position is not None and (last is None or abs(position - last) > 0.01):
+            control_events.publish("LensPosition", round(float(position), 3))
+
+def get_selected_transport(sender):
+    """Describe the ICE candidate pair a session's media flows over, or None if not yet known.
+
+    aiortc doesn't expose the nominated pair publicly, so this reads aioice's connection state.
+    """
+    try:
+        connection = sender.transport.transport._connection
+        pair = next(iter(connection._nominated.values()))
+    except (AttributeError, StopIteration):
+        return None
+    local, remote = pair.local_candidate, pair.remote_candidate
+    return {
+        "protocol": local.transport.lower(),
+        "local": format_address(local.host, local.port),
+        "local_type": local.type,
+        "remote": format_address(remote.host, remote.port),
+        "remote_type": remote.type,
+        # Relayed means a TURN server is in the path, typical of a blocking venue firewall
+        "relayed": "relay" in (local.type, remote.type),
+    }
+
+def request_keyframes():
+    """Ask every connected session for a fresh keyframe"""
+    for pc in list(pcs):
+        for sender in pc.getSenders():
+            request_keyframe(sender)
+
+def log_frame_crc(sender, track, payloads, timestamp):
+    """Log a CRC of one encoded frame's RTP payloads so a debug client can verify what it received"""
+    crc = zlib.crc32(b"".join(payloads))
+    # aiortc offsets RTP timestamps by a random per-sender origin
+    origin = getattr(sender, "timestamp_origin", None)
+    rtp_timestamp = (origin + timestamp) & 0xFFFFFFFF if origin is not None else timestamp
+    logger.info(f"Frame CRC {track.id}: rtp_timestamp={rtp_timestamp} packets={len(payloads)} crc32={crc:08x}")
+
+class ThreadedCodecContext:
+    """Stands in for av.CodecContext in aiortc's H.264 module, giving each libx264 context it
+    creates a fixed thread count before it is opened"""
+
+    threads = None
+
+    @classmethod
+    def create(cls, name, mode=None):
+        codec = av.CodecContext.create(name, mode)
+        if name == "libx264" and cls.threads:
+            codec.thread_count = cls.threads
+        return codec
+
+class ThreadedAv:
+    """The av module as aiortc's H.264 module sees it, with CodecContext swapped"""
+
+    CodecContext = ThreadedCodecContext
+
+    def __getattr__(self, name):
+        return getattr(av, name)
+
+def set_encoder_threads(threads):
+    """Set the thread count of the software H.264 encoders aiortc creates for sessions.
+
+    aiortc creates and opens the libx264 context inside its encode call, so the only place to
+    set the thread count before it opens is the av reference in its H.264 module. None leaves
+    libx264 to pick (about 1.5 threads per core).
+    """
+    ThreadedCodecContext.threads = threads
+    replace_h264_av(ThreadedAv())
+
+def instrument_encoder(encoder, track, sender):
+    """Wrap a session encoder so queueing and encode time are recorded in the pipeline stats.
+
+    A failed encode drops that frame instead of ending the session; repeated failures replace
+    the encoder.
+    """
+    encode = encoder.encode
+    consecutive_errors = 0
+    loop = asyncio.get_event_loop()
+    
+    def timed_encode(frame, *args, **kwargs):
+        nonlocal consecutive_errors
+        start = time.monotonic()
+        handed_off = track.pop_handoff_time(frame.pts)
+        if handed_off is not None:
+            pipeline_stats.record("encoder_queue", start - handed_off)
+        try:
+            result = encode(frame, *args, **kwargs)
+        except Exception as e:
+            consecutive_errors += 1
+            pipeline_stats.count("encoder_errors")
+            sampled_logger.error("encode_error", f"Encoder error on track {track.id}, dropping frame "
+                                                 f"({consecutive_errors}/{ENCODER_REINIT_ERRORS}): {e}")
+            if consecutive_errors >= ENCODER_REINIT_ERRORS:
+                logger.warning(f"Encoder for track {track.id} keeps failing, replacing it")
+                pipeline_stats.count("encoder_reinits")
+                reset_sender_encoder(sender)
+                consecutive_errors = 0
+            # No payloads: aiortc sends nothing for this frame
+            return [], int(frame.pts * frame.time_base * VIDEO_CLOCK_RATE)
+        consecutive_errors = 0
+        pipeline_stats.record("encode", time.monotonic() - start)
+        if node_config.debug_frame_crc:
+            payloads, timestamp = result
+            log_frame_crc(sender, track, payloads, timestamp)
+        # aiortc encodes in an executor thread, so waiters are woken on the event loop
+        force_keyframe = args[0] if args else kwargs.get("force_keyframe", False)
+        if force_keyframe and result[0]:
+            loop.call_soon_threadsafe(track.keyframe_sent)
+        return result
+    
+    encoder.encode = timed_encode
+
+def track_parameter_sets(encoder, track, sender):
+    """Watch the SPS/PPS an H.264 session encoder emits, resending them in-band when configured.
+
+    A change that arrives without an IDR also requests a keyframe, so clients resync as soon
+    as possible. Encoders for other codecs are left alone.
+    """
+    tracker = ParameterSetTracker(track.id, resend=node_config.parameter_sets == "resend")
+    
+    def wrap(encode_frame):
+        def tracked_encode_frame(*args, **kwargs):
+            changes = tracker.changes
+            units, needs_keyframe = tracker.process(list(encode_frame(*args, **kwargs)))
+            if tracker.changes != changes:
+                pipeline_stats.count("parameter_set_changes")
+            if needs_keyframe:
+                request_keyframe(sender)
+            return units
+        return tracked_encode_frame
+    
+    if wrap_encode_frame(encoder, wrap):
+        track.bitstream = tracker
+
+def insert_access_unit_delimiters(encoder):
+    """Start every access unit an H.264 session encoder emits with an access unit delimiter.
+
+    aiortc splits each encoded frame into NAL units before packetizing them, so the delimiter
+    is added as the first NAL unit of each frame. Encoders for other codecs are left alone.
+    """
+    def wrap(encode_frame):
+        def delimited_encode_frame(*args, **kwargs):
+            yield ACCESS_UNIT_DELIMITER
+            yield from encode_frame(*args, **kwargs)
+        return delimited_encode_frame
+    
+    wrap_encode_frame(encoder, wrap)
+
+def stamp_capture_times(encoder, track, sender):
+    """Hand each frame's capture time to the sender's abs-capture-time extension as it's encoded"""
+    extensions_map = get_header_extensions_map(sender)
+    if not isinstance(extensions_map, CaptureTimeExtensionsMap):
+        return
+    encode = encoder.encode
+    
+    def stamped_encode(frame, *args, **kwargs):
+        # Repeated frames have no capture time of their own and go out without the extension
+        extensions_map.capture_time = track.pop_capture_time(frame.pts)
+        return encode(frame, *args, **kwargs)
+    
+    encoder.encode = stamped_encode
+
+def pace_sender(sender):
+    """Spread a session's RTP packets out instead of sending each frame's packets in one burst.
+
+    After each packet the send loop waits for that packet's share of PACING_HEADROOM times the
+    encoder's target bitrate, which smooths the instantaneous rate seen by constrained links.
+    """
+    def wrap(send_rtp):
+        async def paced_send_rtp(data):
+            await send_rtp(data)
+            encoder = get_sender_encoder(sender)
+            bitrate = getattr(encoder, "target_bitrate", None)
+            if bitrate:
+                await asyncio.sleep(len(data) * 8 / (bitrate * PACING_HEADROOM))
+        return paced_send_rtp
+    
+    wrap_send_rtp(sender.transport, wrap)
+
+def watch_receiver_reports(sender, reports):
+    """Record the RTCP receiver reports a client sends about a sender's stream into reports.
+
+    The packets received are what the sender had sent when the report arrived minus the
+    receiver's cumulative loss, so they trail the true count by the packets still in flight.
+    """
+    def wrap(handle_rtcp_packet):
+        async def recording_handle_rtcp_packet(packet):
+            ssrc = get_sender_ssrc(sender)
+            for report in getattr(packet, "reports", []):
+                if report.ssrc != ssrc:
+                    continue
+                previous = reports.get("highest_sequence")
+                packets_sent = sender_packet_count(sender)
+                now = time.monotonic()
+                reports.update({
+                    "received_at": time.time(),
+                    "monotonic": now,
+                    "highest_sequence": report.highest_sequence,
+                    "packets_lost": report.packets_lost,
+                    "packets_sent": packets_sent,
+                    "packets_received": max(0, packets_sent - report.packets_lost),
+                    "advancing": previous is None or report.highest_sequence != previous,
+                })
+                history = reports.setdefault("history", collections.deque())
+                history.append((now, report.highest_sequence, report.packets_lost, packets_sent))
+                # Keep one sample older than the window so the estimate always spans all of it
+                while len(history) > 2 and history[1][0] < now - LOSS_WINDOW:
+                    history.popleft()
+            await handle_rtcp_packet(packet)
+        return recording_handle_rtcp_packet
+    
+    wrap_rtcp_handler(sender, wrap)
+
+def receiver_report_status(reports, paused=False):
+    """Summarize a track's receiver reports as whether its viewer is actually getting data"""
+    if not reports:
+        return {"receiving": False, "last_receiver_report": None, "seconds_since_report": None,
+                "packets_received": None, "packets_lost": None}
+    age = time.monotonic() - reports["monotonic"]
+    # A paused track sends nothing, so only the reports arriving says the viewer is still there
+    receiving = age <= RECEIVER_REPORT_TIMEOUT and (paused or reports["advancing"])
+    return {
+        "receiving": receiving,
+        "last_receiver_report": reports["received_at"],
+        "seconds_since_report": round(age, 3),
+        "packets_received": reports["packets_received"],
+        "packets_lost": reports["packets_lost"],
+    }
+
+def loss_estimate(reports):
+    """Estimate a track's loss rate over the last LOSS_WINDOW seconds of receiver reports.
+
+    Loss is the growth of the receiver's cumulative lost count over the growth of its extended
+    highest sequence number, as RFC 3550 computes the fraction lost, but over a longer window
+    than one report interval so a single late report doesn't swing it. Returns None until two
+    reports have arrived.
+    """
+    history = reports.get("history")
+    if not history or len(history) < 2:
         return None
+    start, end = history[0], history[-1]
+    expected = end[1] - start[1]
+    lost = end[2] - start[2]
+    return {
+        "window": round(end[0] - start[0], 3),
+        "packets_sent": end[3] - start[3],
+        "packets_expected": expected,
+        "packets_lost": lost,
+        # Duplicates can make the lost count shrink, which reads as no loss rather than negative
+        "loss_rate": round(min(1.0, max(0.0, lost / expected)), 4) if expected > 0 else 0.0,
+    }
+
+def session_counters(session, kind):
+    """Cumulative send counters of one track of a session since it connected"""
+    track = session["tracks"][kind]
+    return {
+        "frames_sent": track.frames_sent,
+        "packets_sent": sender_packet_count(track.sender),
+        "bytes_sent": sender_octet_count(track.sender),
+        "send_queue_drops": track.send_queue_drops,
+        "packets_lost": session["receiver_reports"][kind].get("packets_lost", 0),
+    }
+
+def session_stats(session):
+    """A session's per-track counters since it connected or its stats were last reset"""
+    stats = {}
+    for kind in session["tracks"]:
+        baseline = session["stats_baseline"].get(kind, {})
+        stats[kind] = {name: value - baseline.get(name, 0) for name, value in session_counters(session, kind).items()}
+    return stats
+
+def reset_session_stats(session):
+    """Zero a session's counters without touching the connection; the raw counts keep running"""
+    session["stats_baseline"] = {kind: session_counters(session, kind) for kind in session["tracks"]}
+    session["stats_since"] = time.time()
+
+def table_bitrate(size):
+    """The bitrate_table entry for a frame size: its own "WxH" entry, else the one nearest in pixel count"""
+    entries = {parse_size(key): bitrate for key, bitrate in node_config.bitrate_table.items()}
+    if size in entries:
+        return entries[size]
+    nearest = min(entries, key=lambda entry: abs(entry[0] * entry[1] - size[0] * size[1]))
+    return entries[nearest]
+
+async def monitor_session(sender, track, max_bitrate=None, pc=None):
+    """Per-session housekeeping: encoder instrumentation, bitrate limits and round trip time.
+
+    aiortc moves the target bitrate from receiver feedback, so the cap and the configured floor
+    are re-applied periodically. A session whose RTP writes have failed is closed rather than
+    left to encode for a dead connection.
+    """
+    instrumented = None
+    # Frame size the bitrate_table entry was last applied for
+    sized_for = None
+    last_hold_keyframe = 0.0
+    while True:
+        now = time.monotonic()
+        if (node_config.hold_keyframe_interval and frame_hub.latest is not None
+                and now - frame_hub.latest.monotonic > FRAME_WAIT_TIMEOUT
+                and now - last_hold_keyframe >= node_config.hold_keyframe_interval):
+            # The track is repeating the last frame; resend it as a keyframe so a decoder that
+            # lost packets in the meantime recovers the held image instead of showing garbage
+            request_keyframe(sender)
+            last_hold_keyframe = now
+        
+        if (rtp_loop_exited(sender) and track.is_active
+                and (pc is None or pc.connectionState not in ("closed", "failed"))):
+            logger.error(f"RTP writes for track {track.id} failed while the session was up, closing it")
+            pipeline_stats.count("session_send_failures")
+            if pc is not None:
+                await pc.close()
+            return
+        
+        encoder = get_sender_encoder(sender)
+        if encoder is not None:
+            size = get_output_size()
+            size_bitrate = table_bitrate(size) if node_config.bitrate_table else None
+            cap = min((limit for limit in (max_bitrate, size_bitrate) if limit), default=None)
+            # A replaced encoder needs instrumenting again
+            if encoder is not instrumented:
+                instrument_encoder(encoder, track, sender)
+                track_parameter_sets(encoder, track, sender)
+                if node_config.insert_aud:
+                    insert_access_unit_delimiters(encoder)
+                if node_config.abs_capture_time:
+                    stamp_capture_times(encoder, track, sender)
+                instrumented = encoder
+                sized_for = None
+                if node_config.target_bitrate and hasattr(encoder, "target_bitrate"):
+                    encoder.target_bitrate = min(node_config.target_bitrate, max_bitrate or node_config.target_bitrate)
+            if size_bitrate and size != sized_for and hasattr(encoder, "target_bitrate"):
+                # A new resolution starts at its own bitrate rather than one picked for another size
+                encoder.target_bitrate = cap
+                sized_for = size
+                logger.info(f"Session bitrate for track {track.id} set to {cap} bps for {size[0]}x{size[1]}")
+            if cap is not None and hasattr(encoder, "target_bitrate") and encoder.target_bitrate > cap:
+                encoder.target_bitrate = cap
+            if node_config.min_bitrate and hasattr(encoder, "target_bitrate") and encoder.target_bitrate < node_config.min_bitrate:
+                # Keep enough detail for the beacon detector even when the link reports loss
+                encoder.target_bitrate = node_config.min_bitrate
+        
+        try:
+            for stats in (await sender.getStats()).values():
+                if stats.type == "remote-inbound-rtp" and stats.roundTripTime is not None:
+                    pipeline_stats.record("network", stats.roundTripTime)
+                if stats.type == "remote-inbound-rtp" and stats.jitter is not None:
+                    # Reported in RTP timestamp units of the video clock
+                    pipeline_stats.record("jitter", stats.jitter / VIDEO_CLOCK_RATE)
+        except Exception as e:
+            logger.debug(f"Could not read sender stats: {e}")
+        
+        await asyncio.sleep(SESSION_MONITOR_INTERVAL)
 
 class Picamera2Track(MediaStreamTrack):
     """Video stream track for sending camera frames"""
     kind = "video"
 
-    def __init__(self, camera_instance, loop):
+    def __init__(self, hub):
         super().__init__()
-        self.camera = camera_instance
-        self._loop = loop
-        self._pts = 0
-        self._frame_interval = 1/30  # 30fps
-        self._last_frame = None
-        self._consecutive_errors = 0
-        self._max_errors = 5
+        self.hub = hub
+        self._pts_clock = PtsClock(VIDEO_CLOCK_RATE, node_config.framerate)
+        self._frame_interval = 1 / node_config.framerate
+        self._last_sequence = 0
+        self._queue = None
+        # Frames dropped by send queues this track has already unsubscribed
+        self._queue_drops = 0
+        self._last_sent = None
+        self._frames_sent = 0
         self._active = True
         self._track_id = f"video-{id(self)}"
+        self._handoff_times = {}
+        self._capture_times = {}
+        self._resumed = asyncio.Event()
+        self._resumed.set()
+        self._keyframe_waiters = []
+        # Set by the session once it is known
+        self.sender = None
+        self.metadata_channel = None
+        # The H.264 encoder's ParameterSetTracker, once the first frame is encoded
+        self.bitstream = None
         
         # Add track to active tracks set
         active_tracks.add(self)
@@ -119,117 +1283,489 @@ class Picamera2Track(MediaStreamTrack):
             return
             
         self._active = False
+        self._unsubscribe()
+        # Wake a paused recv() so it can end
+        self._resumed.set()
         
         # Remove from active tracks
         if self in active_tracks:
             active_tracks.remove(self)
             
         logger.info(f"Stopped track {self._track_id}, remaining tracks: {len(active_tracks)}")
+    
+    @property
+    def is_active(self):
+        return self._active
+    
+    @property
+    def paused(self):
+        return not self._resumed.is_set()
+    
+    def pause(self):
+        """Stop sending frames until resumed; the camera and other sessions are unaffected"""
+        self._resumed.clear()
+        # A paused track must not fill (or, with the block policy, stall) its send queue
+        self._unsubscribe()
+    
+    async def wait_keyframe(self, timeout):
+        """Request a keyframe and wait until the encoder has emitted it.
+
+        Raises asyncio.TimeoutError if none is emitted within the timeout, e.g. while paused.
+        """
+        waiter = asyncio.get_event_loop().create_future()
+        self._keyframe_waiters.append(waiter)
+        request_keyframe(self.sender)
+        try:
+            await asyncio.wait_for(waiter, timeout)
+        finally:
+            if waiter in self._keyframe_waiters:
+                self._keyframe_waiters.remove(waiter)
+    
+    def keyframe_sent(self):
+        """Called once a forced keyframe has been encoded"""
+        waiters, self._keyframe_waiters = self._keyframe_waiters, []
+        for waiter in waiters:
+            if not waiter.done():
+                waiter.set_result(True)
+    
+    @property
+    def frames_sent(self):
+        return self._frames_sent
+    
+    @property
+    def send_queue_drops(self):
+        return self._queue_drops + (self._queue.drops if self._queue is not None else 0)
+    
+    def _unsubscribe(self):
+        if self._queue is not None:
+            self._queue_drops += self._queue.drops
+            self.hub.unsubscribe(self._queue)
+            self._queue = None
+    
+    def resume(self):
+        """Start sending frames again, beginning with a keyframe"""
+        if self.paused:
+            self._resumed.set()
+            if self.sender is not None:
+                request_keyframe(self.sender)
+    
+    def _send_metadata(self, captured, pts):
+        """Send the capture sequence and time of a frame on the metadata data channel, if open"""
+        channel = self.metadata_channel
+        if channel is None or channel.readyState != "open":
+            return
+        # aiortc offsets RTP timestamps by a random per-sender origin; with the video clock
+        # time base the pts is otherwise the RTP timestamp
+        origin = getattr(self.sender, "timestamp_origin", 0)
+        record = struct.pack(FRAME_METADATA_FORMAT, captured.sequence & 0xFFFFFFFF,
+                             int(captured.timestamp * 1e9), (origin + pts) & 0xFFFFFFFF)
+        channel.send(record)
+    
+    def pop_handoff_time(self, pts):
+        """Return when the frame with this pts was handed to aiortc"""
+        return self._handoff_times.pop(pts, None)
+    
+    def pop_capture_time(self, pts):
+        """Return the wall clock capture time of the frame with this pts"""
+        return self._capture_times.pop(pts, None)
+    
+    def _make_frame(self, array, frames=1):
+        """Wrap a YUV420 array in a timestamped VideoFrame.
+
+        frames is how many capture intervals after the previous frame it was captured, so skipped
+        frames don't speed up playback.
+        """
+        frame = VideoFrame.from_ndarray(array, format="yuv420p")  # Match the YUV420 format
+        tag_color_range(frame, node_config.color_range)
+        frame.pts = self._pts_clock.next_pts(frames)
+        frame.time_base = fractions.Fraction(1, VIDEO_CLOCK_RATE)
+        
+        # Bounded in case frames never reach an encoder (e.g. before the session connects)
+        if len(self._handoff_times) > 100:
+            self._handoff_times.clear()
+        self._handoff_times[frame.pts] = time.monotonic()
+        return frame
         
     async def recv(self):
-        """Get the next frame from the camera"""
+        """Get the next frame from the shared capture"""
         if not self._active:
             # Track has been stopped, raise end-of-file
             raise MediaStreamError("Track ended")
         
+        if self.paused:
+            await self._resumed.wait()
+            if not self._active:
+                raise MediaStreamError("Track ended")
+        
         try:
-            # Capture a frame from the camera
-            numpy_frame = await self._loop.run_in_executor(None, self.camera.capture_array, "main")
-            
-            if numpy_frame is None:
-                raise ValueError("Captured None frame")
-            
-            # Save the last good frame
-            self._last_frame = numpy_frame
-            self._consecutive_errors = 0
-                
-            # Convert to VideoFrame
-            frame = VideoFrame.from_ndarray(numpy_frame, format="yuv420p")  # Match the YUV420 format
-            frame.pts = self._pts
-            frame.time_base = fractions.Fraction(1, 90000)  # Standard timebase for WebRTC
-            self._pts += int(self._frame_interval * 90000)
+            sent_sequence = self._last_sequence
+            while True:
+                if self._queue is None:
+                    self._queue = self.hub.subscribe(node_config.send_queue_frames, node_config.drop_policy)
+                captured = await self._queue.get(timeout=FRAME_WAIT_TIMEOUT)
+                self._last_sequence = captured.sequence
+                # Frames over the soft frame rate cap are skipped, not queued
+                if frame_rate_limiter.allows(self._last_sent, captured.monotonic, self._frame_interval):
+                    break
+            self._last_sent = captured.monotonic
+            self._frames_sent += 1
+            # Extra recovery points on top of the encoder's own keyframes
+            if (node_config.idr_interval and self.sender is not None
+                    and self._frames_sent % node_config.idr_interval == 0):
+                request_keyframe(self.sender)
+            frames = captured.sequence - sent_sequence if sent_sequence else 1
+            frame = self._make_frame(captured.array, frames)
+            self._send_metadata(captured, frame.pts)
+            if len(self._capture_times) > 100:
+                self._capture_times.clear()
+            self._capture_times[frame.pts] = captured.timestamp
             return frame
             
-        except Exception as e:
+        except asyncio.TimeoutError:
             if not self._active:
                 raise MediaStreamError("Track ended")
-                
-            self._consecutive_errors += 1
-            logger.error(f"Error capturing frame ({self._consecutive_errors}/{self._max_errors}): {e}")
             
-            # Try to recover camera if we have multiple errors
-            if self._consecutive_errors >= self._max_errors:
-                logger.warning("Too many consecutive errors, attempting camera recovery...")
-                try:
-                    # Try to reset the camera
-                    self.camera.stop()
-                    time.sleep(1)
-                    self.camera.start()
-                    time.sleep(1)
-                    self._consecutive_errors = 0
-                    logger.info("Camera recovery attempted")
-                except Exception as recovery_error:
-                    logger.error(f"Camera recovery failed: {recovery_error}")
-            
-            # Use last good frame if available
-            if self._last_frame is not None:
-                dummy_array = self._last_frame
-            else:
-                # Create a dummy frame on error - use correct dimensions for your resolution
-                dummy_array = np.zeros((240, 320, 3), dtype=np.uint8)  # Match your 320x240 resolution
-                
-                # Add text about camera error if cv2 is available
-                try:
-                    import cv2
-                    cv2.putText(dummy_array, f"Camera error: {str(e)[:30]}", (10, 120),
-                            cv2.FONT_HERSHEY_SIMPLEX, 0.5, (0, 0, 255), 1)
-                    cv2.putText(dummy_array, f"Reconnecting... ({self._consecutive_errors}/{self._max_errors})", 
-                            (10, 150), cv2.FONT_HERSHEY_SIMPLEX, 0.5, (0, 0, 255), 1)
-                except ImportError:
-                    pass
+            # Camera stalled or failing: use last good frame if available
+            if self.hub.latest is not None:
+                return self._make_frame(self.hub.latest.array)
             
-            # Create frame from dummy array
-            frame = VideoFrame.from_ndarray(dummy_array, format="yuv420p")
-            frame.pts = self._pts
-            frame.time_base = fractions.Fraction(1, 90000)
-            self._pts += int(self._frame_interval * 90000)
-            return frame
+            # Otherwise show the error so the operator knows the camera is the problem
+            width, height = get_output_size()
+            error = self.hub.last_error or "no frames from camera"
+            return self._make_frame(placeholder_frame(width, height, [
+                f"Camera error: {error[:30]}",
+                f"Reconnecting... ({self.hub.consecutive_errors}/{self.hub.max_errors})"
+            ], black_level(node_config.color_range)))
 
-async def handle_offer(request):
-    """Process WebRTC offer from client"""
-    params = await request.json()
-    offer = RTCSessionDescription(sdp=params["sdp"], type=params["type"])
+async def reopen_source(new_source):
+    """Switch the running node to a different frame source without dropping sessions.
 
-    pc = RTCPeerConnection()
-    
-    # Track for cleanup
-    current_track = None
+    Tracks keep repeating the last frame while the capture loop is stopped, then every
+    session gets a keyframe from the new source.
+    """
+    loop = asyncio.get_event_loop()
+    old_source = node_config.source
+    logger.info(f"Switching frame source from {old_source} to {new_source}")
     
-    @pc.on("connectionstatechange")
-    async def on_connectionstatechange():
-        nonlocal current_track
-        logger.info(f"Connection state: {pc.connectionState}")
-        
-        if pc.connectionState == "failed" or pc.connectionState == "closed" or pc.connectionState == "disconnected":
-            # Clean up track when connection ends
-            if current_track:
-                await current_track.stop()
-                current_track = None
-                
-            # Clean up peer connection
-            await pc.close()
-            pcs.discard(pc)
-            
-            # If no more connections, log stats
-            if not pcs:
-                logger.info(f"No active connections. Active tracks: {len(active_tracks)}")
-                
-                # If there are orphaned tracks, log a warning
-                if active_tracks:
-                    logger.warning(f"Orphaned tracks detected: {len(active_tracks)}")
+    await frame_hub.stop()
+    old_camera = camera_obj
+    try:
+        await loop.run_in_executor(None, old_camera.stop)
+        await loop.run_in_executor(None, old_camera.close)
+    except Exception as e:
+        logger.warning(f"Error closing {old_source}: {e}")
     
-    # Set remote description first
-    await pc.setRemoteDescription(offer)
+    node_config.source = new_source
+    if not await loop.run_in_executor(None, init_camera):
+        logger.error(f"Could not open {new_source}, reverting to {old_source}")
+        node_config.source = old_source
+        if not await loop.run_in_executor(None, init_camera):
+            logger.error(f"Could not reopen {old_source} either")
+            return False
+    
+    frame_hub.camera = camera_obj
+    frame_hub.start()
+    asyncio.ensure_future(watch_first_frame())
+    request_keyframes()
+    logger.info(f"Now streaming from {node_config.source}")
+    return node_config.source == new_source
+
+async def restart_pipeline(reason):
+    """Tear down and reopen the camera while the HTTP server and sessions stay up.
+
+    Consumers keep waiting on the same FrameHub, so sessions resume with a keyframe.
+    """
+    global node_ready, pipeline_state
+    loop = asyncio.get_event_loop()
+    logger.warning(f"Restarting the capture pipeline: {reason}")
+    pipeline_state = "restarting"
+    node_ready = False
+    
+    await frame_hub.stop()
+    if camera_obj:
+        try:
+            await loop.run_in_executor(None, camera_obj.stop)
+            await loop.run_in_executor(None, camera_obj.close)
+        except Exception as e:
+            logger.warning(f"Error closing the camera: {e}")
+    
+    if not await loop.run_in_executor(None, init_camera):
+        logger.error("Capture pipeline restart failed, camera could not be initialized")
+        return False
+    
+    frame_hub.camera = camera_obj
+    frame_hub.consecutive_errors = 0
+    frame_hub.start()
+    asyncio.ensure_future(watch_first_frame())
+    request_keyframes()
+    pipeline_state = "running"
+    node_ready = True
+    logger.info("Capture pipeline restarted")
+    return True
+
+async def watch_first_frame():
+    """Fail a camera that opened but delivers no frame within first_frame_timeout.
+
+    A bad cable or the wrong input selected otherwise looks healthy but silent. The camera is
+    reported on /healthz as "no-signal", the supervisor (with auto_restart) reopens it, and with
+    no_signal_card set viewers see a NO SIGNAL card meanwhile.
+    """
+    global camera_obj, camera_error, node_ready, pipeline_state
+    if node_config.first_frame_timeout is None:
+        return
+    watched = camera_obj
+    try:
+        await frame_hub.next_frame(frame_hub.sequence, timeout=node_config.first_frame_timeout)
+        return
+    except asyncio.TimeoutError:
+        pass
+    if camera_obj is not watched or maintenance_mode:
+        # Replaced in the meantime; its replacement has its own watch
+        return
+    
+    camera_error = CameraError(TRANSIENT, f"opened but delivered no frame within {node_config.first_frame_timeout}s, "
+                                          f"check the cable and the selected input")
+    logger.error(f"Camera {camera_error}")
+    pipeline_state = "no-signal"
+    node_ready = False
+    if not node_config.no_signal_card:
+        return
+    
+    loop = asyncio.get_event_loop()
+    await frame_hub.stop()
+    try:
+        await loop.run_in_executor(None, camera_obj.stop)
+        await loop.run_in_executor(None, camera_obj.close)
+    except Exception as e:
+        logger.warning(f"Error closing the camera: {e}")
+    frame_hub.camera = init_placeholder(NO_SIGNAL_LINES)
+    frame_hub.start()
+    request_keyframes()
+    logger.info("Streaming the NO SIGNAL card until the camera is reopened")
+
+async def set_maintenance_mode(enabled):
+    """Swap between the camera and the maintenance card without dropping sessions"""
+    global maintenance_mode
+    if enabled == maintenance_mode:
+        return True
+    maintenance_mode = enabled
+    return await restart_pipeline("entering maintenance mode" if enabled else "leaving maintenance mode")
+
+async def supervise_pipeline():
+    """Restart the capture pipeline when it stops delivering frames, within a restart rate limit.
+
+    Exceeding max_restarts within restart_window_seconds stops the server with a failure status,
+    so a service manager can take over instead of the node restarting in a loop.
+    """
+    global pipeline_state
+    last_restart = time.monotonic()
+    while True:
+        await asyncio.sleep(SUPERVISOR_INTERVAL)
+        now = time.monotonic()
+        latest = frame_hub.latest.monotonic if frame_hub.latest is not None else 0.0
+        # The NO SIGNAL card keeps frames flowing, but the camera behind it still needs reopening
+        no_signal = pipeline_state == "no-signal"
+        if camera_obj and not no_signal and now - max(latest, last_restart) < PIPELINE_STALL_TIMEOUT:
+            continue
+        if no_signal and now - last_restart < PIPELINE_STALL_TIMEOUT:
+            continue
+        
+        if not camera_obj and camera_error is not None and not camera_error.retryable:
+            # Reopening can't fix a permission or format problem, so hand over to the service manager
+            logger.error(f"Camera cannot be opened ({camera_error}), not retrying until the setup is fixed")
+            pipeline_state = "failed"
+            server_stop.set()
+            return
+        
+        while restart_times and now - restart_times[0] > node_config.restart_window_seconds:
+            restart_times.popleft()
+        if len(restart_times) >= node_config.max_restarts:
+            logger.error(f"Capture pipeline restarted {len(restart_times)} times in "
+                         f"{node_config.restart_window_seconds}s, giving up")
+            pipeline_state = "failed"
+            server_stop.set()
+            return
+        
+        restart_times.append(now)
+        last_restart = now
+        reason = "camera not initialized" if not camera_obj else \
+            "no frames since the camera opened" if no_signal else \
+            f"no frames for {PIPELINE_STALL_TIMEOUT:.0f}s ({frame_hub.last_error or 'no error reported'})"
+        await restart_pipeline(reason)
+
+async def reconfigure_output(crop_aspect, crop_mode):
+    """Change the streamed frame size without dropping sessions.
+
+    Capture stops while the frame pipeline is rebuilt, so no consumer sees a mix of sizes. Every
+    consumer then picks up the new size from the first frame: WebRTC encoders re-open at it and
+    start on a keyframe, the archive starts a new segment, the publisher re-announces its stream
+    and the replay buffer starts over.
+    """
+    global frame_pipeline
+    old_size = get_output_size()
+    old_settings = (node_config.crop_aspect, node_config.crop_mode)
+    
+    await frame_hub.stop()
+    try:
+        node_config.crop_aspect, node_config.crop_mode = crop_aspect, crop_mode
+        try:
+            frame_pipeline = build_frame_pipeline()
+        except ValueError as e:
+            logger.error(f"Cannot apply crop_aspect {crop_aspect} ({crop_mode}), keeping the current framing: {e}")
+            node_config.crop_aspect, node_config.crop_mode = old_settings
+            return
+        frame_hub.pipeline = frame_pipeline
+    finally:
+        if camera_obj:
+            frame_hub.start()
+    
+    new_size = get_output_size()
+    logger.info(f"Output reconfigured from {old_size[0]}x{old_size[1]} to {new_size[0]}x{new_size[1]}")
+    request_keyframes()
+
+async def reload_config(remote_data=None):
+    """Re-read the node configuration (on SIGHUP) and apply the settings that can change live"""
+    logger.info(f"Reloading node configuration from {config_path}")
+    loop = asyncio.get_event_loop()
+    try:
+        # May fetch from the configuration server, so kept off the event loop
+        new_config = await loop.run_in_executor(None, load_node_config, config_path, config_preset, remote_data)
+    except (OSError, ValueError) as e:
+        logger.error(f"Could not reload node configuration, keeping the current one: {e}")
+        return
+    
+    errors = new_config.validate()
+    if errors:
+        for error in errors:
+            logger.error(f"Invalid node configuration, keeping the current one: {error}")
+        return
+    
+    old_values = dataclasses.asdict(node_config)
+    changed = {key for key, value in dataclasses.asdict(new_config).items() if old_values[key] != value}
+    for key in sorted(changed - HOT_RELOAD_SETTINGS):
+        logger.warning(f"Changed setting '{key}' needs a restart to take effect")
+    
+    if "source" in changed:
+        await reopen_source(new_config.source)
+    
+    if changed & {"crop_aspect", "crop_mode"}:
+        await reconfigure_output(new_config.crop_aspect, new_config.crop_mode)
+    
+    node_config.control_rate = new_config.control_rate
+    node_config.control_debounce_ms = new_config.control_debounce_ms
+    node_config.control_deadband = new_config.control_deadband
+    if control_writer:
+        control_writer.min_interval = 1.0 / node_config.control_rate
+        control_writer.debounce = node_config.control_debounce_ms / 1000.0
+        control_writer.deadband = node_config.control_deadband or {}
+
+async def watch_remote_config():
+    """Poll the central configuration server and reload when this node's settings there change"""
+    loop = asyncio.get_event_loop()
+    url = remote_config_url(node_config.remote_config_url)
+    last_data = None
+    while True:
+        try:
+            data = await loop.run_in_executor(None, fetch_remote_config, node_config.remote_config_url)
+        except (OSError, ValueError) as e:
+            logger.debug(f"Could not check {url} for configuration changes: {e}")
+            data = last_data
+        if last_data is not None and data != last_data:
+            logger.info(f"Node configuration on {url} changed")
+            await reload_config(remote_data=data)
+        last_data = data
+        await asyncio.sleep(node_config.remote_config_interval)
+
+def set_sdp_session_name(sdp, name):
+    """Replace the session name (s= line) of an SDP, which players show as the stream title"""
+    # SDP lines can't contain line breaks
+    name = " ".join(name.split())
+    return "\r\n".join(f"s={name}" if line.startswith("s=") else line for line in sdp.split("\r\n"))
+
+async def handle_offer(request):
+    """Process WebRTC offer from client"""
+    params = await request.json()
+    offer = RTCSessionDescription(sdp=params["sdp"], type=params["type"])
+    
+    session_id = uuid.uuid4().hex[:8]
+    audit = {"session_id": session_id, "remote": request.remote, "path": request.path, "transport": "webrtc"}
+    audit_log.record("connect", **audit)
+    
+    # Optional per-session bitrate cap requested by the client (bits per second)
+    max_bitrate = params.get("max_bitrate")
+    if max_bitrate is not None:
+        try:
+            max_bitrate = int(max_bitrate)
+        except (TypeError, ValueError):
+            audit_log.record("rejected", reason="invalid max_bitrate", **audit)
+            return web.Response(status=400, text=f"Invalid max_bitrate: {max_bitrate}")
+        if max_bitrate < MIN_SESSION_BITRATE:
+            audit_log.record("rejected", reason="max_bitrate below minimum", **audit)
+            return web.Response(status=400,
+                                text=f"max_bitrate {max_bitrate} is below the minimum of {MIN_SESSION_BITRATE} bps")
+        if node_config.min_bitrate and max_bitrate < node_config.min_bitrate:
+            logger.info(f"Raising requested max_bitrate {max_bitrate} to the configured floor of {node_config.min_bitrate} bps")
+            max_bitrate = node_config.min_bitrate
+
+    pc = RTCPeerConnection()
+    
+    # Track for cleanup
+    current_track = None
+    sender = None
+    session_task = None
+    torn_down = False
+    
+    @pc.on("datachannel")
+    def on_datachannel(channel):
+        if channel.label != FRAME_METADATA_CHANNEL:
+            logger.warning(f"Ignoring unknown data channel '{channel.label}'")
+            return
+        logger.info(f"Session {session_id} subscribed to frame metadata")
+        if current_track:
+            current_track.metadata_channel = channel
+    
+    @pc.on("connectionstatechange")
+    async def on_connectionstatechange():
+        nonlocal current_track, session_task, torn_down
+        logger.info(f"Connection state: {pc.connectionState}")
+        
+        if pc.connectionState == "connected":
+            selected = get_selected_transport(sender)
+            if selected:
+                logger.info(f"Session {session_id} playing over {selected['protocol'].upper()} "
+                            f"{selected['local']} ({selected['local_type']}) <-> "
+                            f"{selected['remote']} ({selected['remote_type']})")
+            audit_log.record("play", transport_path=selected, **audit)
+        
+        if pc.connectionState == "failed" or pc.connectionState == "closed" or pc.connectionState == "disconnected":
+            if not torn_down:
+                torn_down = True
+                audit_log.record("teardown", state=pc.connectionState, **audit)
+            
+            if session_task:
+                session_task.cancel()
+                session_task = None
+            
+            # Clean up track when connection ends
+            if current_track:
+                await current_track.stop()
+                current_track = None
+                
+            # Clean up peer connection
+            await pc.close()
+            pcs.discard(pc)
+            sessions.pop(session_id, None)
+            
+            # If no more connections, log stats
+            if not pcs:
+                logger.info(f"No active connections. Active tracks: {len(active_tracks)}")
+                
+                # If there are orphaned tracks, log a warning
+                if active_tracks:
+                    logger.warning(f"Orphaned tracks detected: {len(active_tracks)}")
+    
+    # Set remote description first
+    await pc.setRemoteDescription(offer)
     
     # Add to tracked connections
     pcs.add(pc)
@@ -238,28 +1774,121 @@ async def handle_offer(request):
     # Setup video track
     if not camera_obj:
         logger.error("Camera not initialized")
+        audit_log.record("rejected", reason="camera not initialized", **audit)
         return web.Response(status=500, text="Camera not initialized")
         
-    loop = asyncio.get_event_loop()
-    video_track = Picamera2Track(camera_instance=camera_obj, loop=loop)
+    video_track = Picamera2Track(frame_hub)
     current_track = video_track
     
     # Add video track to peer connection
-    pc.addTrack(video_track)
-    logger.info(f"Added video track to peer connection")
+    sender = pc.addTrack(video_track)
+    video_track.sender = sender
+    if node_config.abs_capture_time:
+        # Replaced before negotiation finishes, so it's configured with the answer's extension ids
+        set_header_extensions_map(sender, CaptureTimeExtensionsMap())
+    if node_config.pacing:
+        pace_sender(sender)
+    # aiortc picks a random SSRC per sender and uses it for both RTP and RTCP sender reports
+    ssrc = get_sender_ssrc(sender)
+    receiver_reports = {}
+    watch_receiver_reports(sender, receiver_reports)
+    sessions[session_id] = {"pc": pc, "tracks": {video_track.kind: video_track}, "remote": request.remote,
+                            "ssrc": {video_track.kind: ssrc}, "receiver_reports": {video_track.kind: receiver_reports},
+                            "stats_baseline": {}, "stats_since": time.time()}
+    logger.info(f"Added video track to peer connection (ssrc {ssrc})")
+    audit_log.record("setup", track=video_track.kind, ssrc=ssrc, **audit)
+    
+    session_task = asyncio.ensure_future(monitor_session(sender, video_track, max_bitrate, pc))
+    if max_bitrate is not None:
+        logger.info(f"Capped session bitrate for {request.remote} to {max_bitrate} bps")
     
     # Create answer
     answer = await pc.createAnswer()
     await pc.setLocalDescription(answer)
     
+    sdp = pc.localDescription.sdp
+    if node_config.stream_name:
+        sdp = set_sdp_session_name(sdp, node_config.stream_name)
+    
     return web.Response(
         content_type="application/json",
         text=json.dumps({
-            "sdp": pc.localDescription.sdp, 
-            "type": pc.localDescription.type
+            "sdp": sdp, 
+            "type": pc.localDescription.type,
+            "session_id": session_id
         })
     )
 
+async def handle_session_pause(request):
+    """API endpoint to pause or resume one track of a session, e.g. {"track": "video", "paused": true}"""
+    session = sessions.get(request.match_info["session_id"])
+    if session is None:
+        return web.Response(status=404, text="Unknown session")
+    
+    try:
+        params = await request.json()
+        paused = params["paused"]
+        if not isinstance(paused, bool):
+            raise ValueError("paused must be true or false")
+    except (KeyError, ValueError) as e:
+        return web.Response(status=400, text=f"Invalid pause request: {e}")
+    
+    kind = params.get("track", "video")
+    track = session["tracks"].get(kind)
+    if track is None:
+        return web.Response(status=404, text=f"Session has no {kind} track")
+    
+    if paused:
+        track.pause()
+    else:
+        track.resume()
+    logger.info(f"{'Paused' if paused else 'Resumed'} {kind} for session {request.match_info['session_id']}")
+    return web.json_response({kind: {"paused": track.paused} for kind, track in session["tracks"].items()})
+
+async def handle_session_reset_stats(request):
+    """API endpoint to zero one session's counters, e.g. before reproducing a glitch"""
+    session_id = request.match_info["session_id"]
+    session = sessions.get(session_id)
+    if session is None:
+        return web.Response(status=404, text="Unknown session")
+    reset_session_stats(session)
+    logger.info(f"Reset the stats of session {session_id}")
+    return web.json_response({"stats_since": session["stats_since"], "counters": session_stats(session)})
+
+async def handle_sessions_reset_stats(request):
+    """API endpoint to zero the counters of every session"""
+    for session in sessions.values():
+        reset_session_stats(session)
+    logger.info(f"Reset the stats of {len(sessions)} sessions")
+    return web.json_response({"sessions": list(sessions)})
+
+async def handle_keyframe(request):
+    """API endpoint to force a keyframe, answering once it has been emitted.
+
+    An optional {"session_id": ...} limits it to one session; otherwise every session gets one.
+    """
+    try:
+        params = await request.json() if request.can_read_body else {}
+    except ValueError as e:
+        return web.Response(status=400, text=f"Invalid keyframe request: {e}")
+    session_id = params.get("session_id")
+    if session_id is not None and session_id not in sessions:
+        return web.Response(status=404, text="Unknown session")
+    targets = {session_id: sessions[session_id]} if session_id is not None else dict(sessions)
+    
+    async def wait(track):
+        try:
+            await track.wait_keyframe(KEYFRAME_REQUEST_TIMEOUT)
+            return True
+        except asyncio.TimeoutError:
+            return False
+    
+    tracks = {sid: session["tracks"]["video"] for sid, session in targets.items() if "video" in session["tracks"]}
+    results = await asyncio.gather(*(wait(track) for track in tracks.values()))
+    emitted = dict(zip(tracks, results))
+    logger.info(f"Keyframe requested for {len(emitted)} sessions, emitted by {sum(results)}")
+    return web.json_response({"keyframe_emitted": emitted}, status=200 if all(results) else 504)
+
 async def handle_focus(request):
     """API endpoint to control camera focus"""
     global camera_obj
@@ -267,6 +1896,12 @@ async def handle_focus(request):
     if not camera_obj:
         return web.Response(status=500, text="Camera not initialized")
     
+    unavailable = controls_unavailable()
+    if unavailable:
+        return unavailable
+    if not has_autofocus():
+        return web.Response(status=409, text="Autofocus needs the Pi camera")
+    
     try:
         params = await request.json()
         mode = params.get("mode", "auto")
@@ -277,23 +1912,562 @@ async def handle_focus(request):
         
         if mode == "auto":
             # Set continuous autofocus
-            camera_obj.set_controls({"AfMode": controls.AfModeEnum.Continuous})
+            set_autofocus(True)
             logger.info(f"Set camera to auto focus mode")
             return web.Response(text="Focus mode set to auto")
+        elif mode == "absolute":
+            # Absolute lens position in dioptres, clamped to the lens range
+            applied = set_focus_absolute(params.get("lens_position", 0.0))
+            logger.info(f"Set camera to manual focus, lens position: {applied}")
+            return web.Response(text=f"Focus set to manual, lens position: {applied}")
         elif mode == "manual":
             # Set manual focus - position should be between 0.0 and 1.0
-            camera_obj.set_controls({
+            position = http_controls.submit({
                 "AfMode": controls.AfModeEnum.Manual,
                 "LensPosition": position
-            })
+            })["LensPosition"]
             logger.info(f"Set camera to manual focus, position: {position}")
             return web.Response(text=f"Focus set to manual, position: {position}")
         else:
-            return web.Response(status=400, text="Invalid focus mode. Use 'auto' or 'manual'.")
+            return web.Response(status=400, text="Invalid focus mode. Use 'auto', 'manual' or 'absolute'.")
     except Exception as e:
         logger.error(f"Error setting focus: {e}")
         return web.Response(status=500, text=f"Error setting focus: {e}")
 
+async def handle_focus_state(request):
+    """Endpoint to get the focus mode, lens position and lens range"""
+    if not camera_obj:
+        return web.Response(status=500, text="Camera not initialized")
+    
+    focus_range = get_focus_range()
+    return web.json_response({
+        "mode": control_events.last_values.get("AfMode"),
+        "lens_position": control_events.last_values.get("LensPosition"),
+        "range": None if focus_range is None else {
+            "min": focus_range[0],
+            "max": focus_range[1],
+            "step": focus_range[2]
+        }
+    })
+
+async def handle_ir_mode(request):
+    """API endpoint to enable or disable IR tracking mode"""
+    if not camera_obj:
+        return web.Response(status=500, text="Camera not initialized")
+    
+    unavailable = controls_unavailable()
+    if unavailable:
+        return unavailable
+    
+    try:
+        params = await request.json()
+        enabled = params["enabled"]
+        if not isinstance(enabled, bool):
+            raise ValueError("enabled must be true or false")
+    except (KeyError, ValueError) as e:
+        return web.Response(status=400, text=f"Invalid IR mode request: {e}")
+    
+    try:
+        if enabled:
+            applied = await camera_call(enable_ir_mode)
+        else:
+            applied = disable_ir_mode()
+        return web.json_response({"ir_mode": enabled, "controls": applied},
+                                 dumps=lambda data: json.dumps(data, default=str))
+    except CameraTimeoutError as e:
+        logger.error(f"Error setting IR mode: {e}")
+        return web.Response(status=504, text=f"Error setting IR mode: {e}")
+    except Exception as e:
+        logger.error(f"Error setting IR mode: {e}")
+        return web.Response(status=500, text=f"Error setting IR mode: {e}")
+
+def set_stream_keepalive(request):
+    """Have the kernel detect a half-open long-lived HTTP connection within tcp_idle_timeout"""
+    timeout = node_config.tcp_idle_timeout
+    sock = request.transport.get_extra_info("socket") if request.transport else None
+    if not timeout or sock is None:
+        return
+    try:
+        sock.setsockopt(socket.SOL_SOCKET, socket.SO_KEEPALIVE, 1)
+        if hasattr(socket, "TCP_KEEPIDLE"):
+            # Probe an idle connection three times within the timeout
+            interval = max(1, int(timeout / 4))
+            sock.setsockopt(socket.IPPROTO_TCP, socket.TCP_KEEPIDLE, interval)
+            sock.setsockopt(socket.IPPROTO_TCP, socket.TCP_KEEPINTVL, interval)
+            sock.setsockopt(socket.IPPROTO_TCP, socket.TCP_KEEPCNT, 3)
+        if hasattr(socket, "TCP_USER_TIMEOUT"):
+            # Also give up on data the client has stopped acknowledging
+            sock.setsockopt(socket.IPPROTO_TCP, socket.TCP_USER_TIMEOUT, int(timeout * 1000))
+    except OSError as e:
+        logger.debug(f"Could not enable TCP keepalive for {request.remote}: {e}")
+
+async def write_stream(response, data):
+    """Write to a long-lived response, raising asyncio.TimeoutError if the client stops reading"""
+    if node_config.tcp_idle_timeout:
+        await asyncio.wait_for(response.write(data), node_config.tcp_idle_timeout)
+    else:
+        await response.write(data)
+
+def exposure_calibration():
+    """The EV calibration for the current camera model, or None to work in raw units"""
+    return calibration_for(camera_obj.camera_properties.get("Model"), node_config.ev_calibration)
+
+def read_exposure():
+    """Current exposure time and gain, raw and (when calibrated) in EV.
+
+    Blocks on a metadata capture, so call it from an executor.
+    """
+    values = snapshot_controls(("ExposureTime", "AnalogueGain", "AeEnable"))
+    state = {
+        "auto": values.get("AeEnable"),
+        "exposure_time": values.get("ExposureTime"),
+        "analogue_gain": values.get("AnalogueGain"),
+        "ev": None,
+    }
+    calibration = exposure_calibration()
+    if calibration and state["exposure_time"] and state["analogue_gain"]:
+        exposure_ev = calibration.exposure_ev(state["exposure_time"])
+        gain_ev = calibration.gain_ev(state["analogue_gain"])
+        state["ev"] = {"exposure": round(exposure_ev, 2), "gain": round(gain_ev, 2),
+                       "total": round(exposure_ev + gain_ev, 2)}
+    return state
+
+async def handle_exposure_state(request):
+    """Endpoint to get the exposure time and gain in raw units and EV"""
+    if not camera_obj:
+        return web.Response(status=500, text="Camera not initialized")
+    
+    try:
+        return web.json_response(await camera_call(read_exposure))
+    except CameraTimeoutError as e:
+        logger.error(f"Error reading exposure: {e}")
+        return web.Response(status=504, text=f"Error reading exposure: {e}")
+    except Exception as e:
+        logger.error(f"Error reading exposure: {e}")
+        return web.Response(status=500, text=f"Error reading exposure: {e}")
+
+async def handle_exposure(request):
+    """API endpoint to set a fixed exposure, in EV ({"exposure_ev": 1, "gain_ev": 0}) or
+    raw units ({"exposure_time": 10000, "analogue_gain": 2.0})"""
+    if not camera_obj:
+        return web.Response(status=500, text="Camera not initialized")
+    
+    unavailable = controls_unavailable()
+    if unavailable:
+        return unavailable
+    
+    try:
+        params = await request.json()
+        values = {}
+        if "exposure_ev" in params or "gain_ev" in params:
+            calibration = exposure_calibration()
+            if calibration is None:
+                raise ValueError("no EV calibration for this camera model, use exposure_time/analogue_gain")
+            # Bounded to the camera's range so 2 ** ev can't overflow
+            limits = camera_obj.camera_controls
+            if "exposure_ev" in params:
+                ev = bounded_ev(float(params["exposure_ev"]), limits.get("ExposureTime"), calibration.exposure_ev)
+                values["ExposureTime"] = calibration.exposure_time_for(ev)
+            if "gain_ev" in params:
+                ev = bounded_ev(float(params["gain_ev"]), limits.get("AnalogueGain"), calibration.gain_ev)
+                values["AnalogueGain"] = calibration.gain_for(ev)
+        if "exposure_time" in params:
+            values["ExposureTime"] = int(params["exposure_time"])
+        if "analogue_gain" in params:
+            values["AnalogueGain"] = float(params["analogue_gain"])
+            if not math.isfinite(values["AnalogueGain"]):
+                raise ValueError(f"analogue_gain must be a finite number, got {params['analogue_gain']}")
+        if not values:
+            raise ValueError("expected exposure_ev/gain_ev or exposure_time/analogue_gain")
+    except (TypeError, ValueError, OverflowError) as e:
+        return web.Response(status=400, text=f"Invalid exposure request: {e}")
+    
+    # A fixed exposure only holds with the AE loop off
+    values["AeEnable"] = False
+    try:
+        applied = http_controls.submit(values)
+        return web.json_response({"controls": applied})
+    except Exception as e:
+        logger.error(f"Error setting exposure: {e}")
+        return web.Response(status=500, text=f"Error setting exposure: {e}")
+
+async def handle_ir_cut(request):
+    """API endpoint to move the IR-cut filter in or out without touching exposure"""
+    if not camera_obj:
+        return web.Response(status=500, text="Camera not initialized")
+    
+    try:
+        params = await request.json()
+        enabled = params["enabled"]
+        if not isinstance(enabled, bool):
+            raise ValueError("enabled must be true or false")
+    except (KeyError, ValueError) as e:
+        return web.Response(status=400, text=f"Invalid IR-cut request: {e}")
+    
+    try:
+        await camera_call(set_ir_cut_filter, enabled)
+        return web.json_response({"ir_cut_filter": enabled})
+    except LookupError as e:
+        return web.Response(status=404, text=f"No IR-cut filter: {e}")
+    except CameraTimeoutError as e:
+        logger.error(f"Error setting the IR-cut filter: {e}")
+        return web.Response(status=504, text=f"Error setting the IR-cut filter: {e}")
+    except OSError as e:
+        logger.error(f"Error setting the IR-cut filter: {e}")
+        return web.Response(status=500, text=f"Error setting the IR-cut filter: {e}")
+
+async def handle_inputs(request):
+    """Endpoint to list the inputs of a multi-input V4L2 capture card and the one in use"""
+    if not camera_obj:
+        return web.Response(status=500, text="Camera not initialized")
+    if not hasattr(camera_obj, "list_inputs"):
+        return web.json_response({"inputs": [], "current": None})
+    inputs = await asyncio.get_event_loop().run_in_executor(None, camera_obj.list_inputs)
+    return web.json_response({"inputs": inputs, "current": camera_obj.camera_config.get("video_input")})
+
+async def handle_input_select(request):
+    """API endpoint to capture from another input of a V4L2 capture card.
+
+    The device is reopened so the new input's format is negotiated, and every session gets a
+    keyframe from it.
+    """
+    if not camera_obj:
+        return web.Response(status=500, text="Camera not initialized")
+    
+    try:
+        params = await request.json()
+        index = params["index"]
+        if isinstance(index, bool) or not isinstance(index, int):
+            raise ValueError("index must be an integer")
+    except (KeyError, ValueError) as e:
+        return web.Response(status=400, text=f"Invalid input request: {e}")
+    
+    loop = asyncio.get_event_loop()
+    inputs = await loop.run_in_executor(None, camera_obj.list_inputs) if hasattr(camera_obj, "list_inputs") else []
+    if index not in [item["index"] for item in inputs]:
+        return web.Response(status=404, text=f"No input {index} on {node_config.source}")
+    
+    previous = camera_obj.video_input
+    await frame_hub.stop()
+    try:
+        await loop.run_in_executor(None, camera_obj.set_input, index)
+        node_config.v4l2_input = index
+        selected = True
+    except Exception as e:
+        logger.error(f"Could not switch to input {index}: {e}")
+        camera_obj.video_input = previous
+        await loop.run_in_executor(None, camera_obj.start)
+        selected = False
+    finally:
+        frame_hub.start()
+        asyncio.ensure_future(watch_first_frame())
+        request_keyframes()
+    if not selected:
+        return web.Response(status=500, text=f"Could not switch to input {index}, see the node log")
+    return web.json_response({"input": index})
+
+async def handle_ir_cut_state(request):
+    """Endpoint to get whether the IR-cut filter is in"""
+    if not camera_obj:
+        return web.Response(status=500, text="Camera not initialized")
+    
+    try:
+        enabled = await camera_call(get_ir_cut_filter)
+        return web.json_response({"ir_cut_filter": enabled})
+    except LookupError as e:
+        return web.Response(status=404, text=f"No IR-cut filter: {e}")
+    except CameraTimeoutError as e:
+        logger.error(f"Error reading the IR-cut filter: {e}")
+        return web.Response(status=504, text=f"Error reading the IR-cut filter: {e}")
+    except OSError as e:
+        logger.error(f"Error reading the IR-cut filter: {e}")
+        return web.Response(status=500, text=f"Error reading the IR-cut filter: {e}")
+
+async def handle_events(request):
+    """Server-sent event stream of control changes"""
+    response = web.StreamResponse(headers={
+        "Content-Type": "text/event-stream",
+        "Cache-Control": "no-cache"
+    })
+    await response.prepare(request)
+    set_stream_keepalive(request)
+    
+    queue = control_events.subscribe()
+    try:
+        # Send the current state first so a new UI starts in sync
+        for control, value in list(control_events.last_values.items()):
+            await write_stream(response, f"data: {json.dumps({'control': control, 'value': value}, default=str)}\n\n".encode())
+        while True:
+            try:
+                event = await asyncio.wait_for(queue.get(), node_config.tcp_idle_timeout)
+            except asyncio.TimeoutError:
+                # A comment line keeps quiet streams writing, so a dead client is noticed
+                await write_stream(response, b": keepalive\n\n")
+                continue
+            await write_stream(response, f"data: {json.dumps(event, default=str)}\n\n".encode())
+    except asyncio.TimeoutError:
+        logger.info(f"Event stream client {request.remote} stopped reading, closing it")
+    except (ConnectionResetError, asyncio.CancelledError):
+        pass
+    finally:
+        control_events.unsubscribe(queue)
+    return response
+
+async def handle_logs(request):
+    """Server-sent event stream of the node's log, tail -f style, e.g. /logs?level=warning&backlog=50"""
+    try:
+        level = logging.getLevelName(request.query.get("level", "info").upper())
+        if not isinstance(level, int):
+            raise ValueError(f"unknown level '{request.query['level']}'")
+        backlog = int(request.query.get("backlog", 0))
+        if backlog < 0:
+            raise ValueError("backlog must not be negative")
+    except ValueError as e:
+        return web.Response(status=400, text=f"Invalid log stream request: {e}")
+    
+    response = web.StreamResponse(headers={
+        "Content-Type": "text/event-stream",
+        "Cache-Control": "no-cache"
+    })
+    await response.prepare(request)
+    set_stream_keepalive(request)
+    
+    queue = log_stream.subscribe(level, backlog)
+    try:
+        while True:
+            try:
+                entry = await asyncio.wait_for(queue.get(), node_config.tcp_idle_timeout)
+            except asyncio.TimeoutError:
+                await write_stream(response, b": keepalive\n\n")
+                continue
+            record = {key: value for key, value in entry.items() if key != "levelno"}
+            await write_stream(response, f"data: {json.dumps(record)}\n\n".encode())
+    except asyncio.TimeoutError:
+        logger.info(f"Log stream client {request.remote} stopped reading, closing it")
+    except (ConnectionResetError, asyncio.CancelledError):
+        pass
+    finally:
+        log_stream.unsubscribe(queue)
+    return response
+
+def control_table():
+    """Descriptors of the camera's controls from the cached table, with their current values.
+
+    Blocks on reading the values, so call it from an executor.
+    """
+    if isinstance(camera_obj, StreamFrameSource):
+        return {"descriptors": camera_obj.control_descriptors, "values": camera_obj.read_controls()}
+    # libcamera reports (min, max, default) and keeps the table itself, updating it on reconfigure
+    descriptors = {name: {"min": limits[0], "max": limits[1], "default": limits[2] if len(limits) > 2 else None}
+                   for name, limits in camera_obj.camera_controls.items()}
+    values = dict(control_events.last_values)
+    values.update(camera_obj.capture_metadata())
+    return {"descriptors": descriptors, "values": {name: values[name] for name in descriptors if name in values}}
+
+async def handle_controls(request):
+    """API endpoint listing the camera's controls, their ranges and current values"""
+    if not camera_obj:
+        return web.Response(status=500, text="Camera not initialized")
+    
+    try:
+        table = await camera_call(control_table)
+        return web.json_response(table, dumps=lambda data: json.dumps(data, default=str))
+    except CameraTimeoutError as e:
+        logger.error(f"Error reading controls: {e}")
+        return web.Response(status=504, text=f"Error reading controls: {e}")
+    except Exception as e:
+        logger.error(f"Error reading controls: {e}")
+        return web.Response(status=500, text=f"Error reading controls: {e}")
+
+async def handle_controls_refresh(request):
+    """API endpoint to re-read the control ranges, for the rare case they change (e.g. a mode switch)"""
+    if not camera_obj:
+        return web.Response(status=500, text="Camera not initialized")
+    
+    if isinstance(camera_obj, StreamFrameSource):
+        try:
+            await camera_call(camera_obj.refresh_controls)
+        except CameraTimeoutError as e:
+            logger.error(f"Error refreshing controls: {e}")
+            return web.Response(status=504, text=f"Error refreshing controls: {e}")
+    logger.info("Refreshed the control descriptor table")
+    return await handle_controls(request)
+
+async def handle_controls_reset(request):
+    """API endpoint to reset all image controls to the driver defaults"""
+    if not camera_obj:
+        return web.Response(status=500, text="Camera not initialized")
+    
+    unavailable = controls_unavailable()
+    if unavailable:
+        return unavailable
+    
+    try:
+        defaults = reset_controls()
+        return web.json_response({"reset": defaults}, dumps=lambda data: json.dumps(data, default=str))
+    except Exception as e:
+        logger.error(f"Error resetting controls: {e}")
+        return web.Response(status=500, text=f"Error resetting controls: {e}")
+
+async def handle_presets(request):
+    """API endpoint listing the saved control presets"""
+    return web.json_response({"presets": control_presets.presets})
+
+async def handle_preset_save(request):
+    """API endpoint to save the current image controls as a named preset"""
+    if not camera_obj:
+        return web.Response(status=500, text="Camera not initialized")
+    
+    name = request.match_info["name"]
+    try:
+        values = await camera_call(snapshot_controls, PRESET_CONTROLS)
+        control_presets.save(name, values)
+        logger.info(f"Saved control preset '{name}': {sorted(values)}")
+        return web.json_response({"preset": name, "controls": values},
+                                 dumps=lambda data: json.dumps(data, default=list))
+    except CameraTimeoutError as e:
+        logger.error(f"Error saving control preset '{name}': {e}")
+        return web.Response(status=504, text=f"Error saving control preset: {e}")
+    except Exception as e:
+        logger.error(f"Error saving control preset '{name}': {e}")
+        return web.Response(status=500, text=f"Error saving control preset: {e}")
+
+async def handle_preset_delete(request):
+    """API endpoint to delete a saved control preset"""
+    name = request.match_info["name"]
+    if not control_presets.delete(name):
+        return web.Response(status=404, text=f"No control preset named '{name}'")
+    return web.json_response({"deleted": name})
+
+async def handle_preset_recall(request):
+    """API endpoint to apply a saved control preset"""
+    if not camera_obj:
+        return web.Response(status=500, text="Camera not initialized")
+    
+    unavailable = controls_unavailable()
+    if unavailable:
+        return unavailable
+    
+    name = request.match_info["name"]
+    values = control_presets.presets.get(name)
+    if values is None:
+        return web.Response(status=404, text=f"No control preset named '{name}'")
+    
+    try:
+        applied = restore_controls(values)
+        logger.info(f"Recalled control preset '{name}'")
+        return web.json_response({"preset": name, "controls": applied},
+                                 dumps=lambda data: json.dumps(data, default=str))
+    except Exception as e:
+        logger.error(f"Error recalling control preset '{name}': {e}")
+        return web.Response(status=500, text=f"Error recalling control preset: {e}")
+
+def effective_config(host=None, port=None):
+    """The fully resolved configuration: defaults, config file, preset and command-line overrides"""
+    config = dataclasses.asdict(node_config)
+    config["config_path"] = config_path
+    if config["auth_users"]:
+        # Never hand out the passwords, including to authenticated API users
+        config["auth_users"] = {username: REDACTED for username in config["auth_users"]}
+    for name in URL_SETTINGS:
+        # Nor stream keys and credentials; --print-config output ends up in support tickets
+        config[name] = redact_url(config[name])
+    if port is not None:
+        config["listen"] = format_address(host or "*", port)
+    return config
+
+def negotiated_config():
+    """Values negotiated with the camera, which can differ from what was requested"""
+    negotiated = {"output_size": list(get_output_size())}
+    if camera_obj:
+        try:
+            main_stream = camera_obj.camera_config.get("main", {})
+            negotiated["capture_size"] = list(main_stream.get("size", capture_size))
+            # V4L2 devices report the pixel format the device accepted from pixel_formats
+            negotiated["format"] = main_stream.get("format") or camera_obj.camera_config.get("pixel_format")
+            negotiated["buffer_count"] = camera_obj.camera_config.get("buffer_count")
+            negotiated["colour_space"] = str(camera_obj.camera_config.get("colour_space"))
+            # V4L2 devices report the field mode they capture
+            negotiated["field"] = camera_obj.camera_config.get("field")
+        except (AttributeError, TypeError) as e:
+            logger.debug(f"Could not read the negotiated camera configuration: {e}")
+    return negotiated
+
+async def handle_config(request):
+    """Endpoint to get the configuration the node is actually running with"""
+    config = effective_config(*request.app["listen"])
+    config["negotiated"] = negotiated_config()
+    return web.json_response(config, dumps=lambda data: json.dumps(data, default=str))
+
+def encode_path(codec_name):
+    """Whether an FFmpeg encoder runs on hardware or in software"""
+    return "hardware" if codec_name and codec_name.endswith(HARDWARE_ENCODER_SUFFIXES) else "software"
+
+def pipeline_report():
+    """What the pipeline is actually doing: requested against negotiated format and frame rate, and
+    how each output is encoded at what bitrate"""
+    negotiated = negotiated_config()
+    measured_fps = frame_hub.measured_fps if frame_hub else None
+    sessions_encode = {}
+    for session_id, session in sessions.items():
+        for sender in session["pc"].getSenders():
+            encoder = get_sender_encoder(sender)
+            if encoder is None:
+                continue
+            codec = getattr(encoder, "codec", None)
+            codec_name = codec.name if codec is not None else type(encoder).__name__
+            sessions_encode[session_id] = {"encoder": codec_name, "path": encode_path(codec_name),
+                                           "bitrate": getattr(encoder, "target_bitrate", None)}
+    outputs = {}
+    if publisher is not None:
+        outputs["publish"] = {"encoder": publisher.codec, "path": encode_path(publisher.codec),
+                              "bitrate": publisher.bitrate}
+    if node_config.archive_dir:
+        outputs["archive"] = {"encoder": node_config.archive_codec, "path": encode_path(node_config.archive_codec),
+                              "bitrate": node_config.archive_bitrate}
+    return {
+        "source": node_config.source,
+        "state": pipeline_state,
+        "format": {
+            "requested": {"size": list(capture_size), "pixel_formats": node_config.pixel_formats},
+            "negotiated": {"size": negotiated.get("capture_size"), "format": negotiated.get("format")},
+            "output_size": negotiated["output_size"],
+        },
+        "fps": {
+            "requested": node_config.framerate,
+            "cap": frame_rate_limiter.max_fps,
+            "measured": round(measured_fps, 1) if measured_fps is not None else None,
+        },
+        "frame_pipeline": frame_pipeline.names,
+        # Every output decodes to I420 and re-encodes; nothing is passed through
+        "sessions": sessions_encode,
+        "outputs": outputs,
+    }
+
+def format_pipeline_banner(report):
+    """The pipeline report as a boxed block of log lines"""
+    requested, negotiated = report["format"]["requested"], report["format"]["negotiated"]
+    fps = report["fps"]
+    lines = [
+        f"Source:    {report['source']} ({report['state']})",
+        f"Format:    requested {'x'.join(map(str, requested['size']))} "
+        f"{'/'.join(requested['pixel_formats'] or ['any'])}, negotiated "
+        f"{'x'.join(map(str, negotiated['size'] or ['?']))} {negotiated['format'] or '?'}",
+        f"Output:    {'x'.join(map(str, report['format']['output_size']))} via "
+        f"{' -> '.join(report['frame_pipeline']) or '(no processors)'}",
+        f"Frame rate: requested {fps['requested']}, cap {fps['cap'] or 'none'}, measured {fps['measured'] or '?'}",
+    ]
+    for name, output in report["outputs"].items():
+        lines.append(f"{name.capitalize() + ':':<10} {output['encoder']} ({output['path']}) at {output['bitrate']} bps")
+    lines.append(f"Sessions:  {len(report['sessions'])} encoding")
+    width = max(len(line) for line in lines)
+    border = "+" + "-" * (width + 2) + "+"
+    return [border] + [f"| {line.ljust(width)} |" for line in lines] + [border]
+
+async def handle_pipeline(request):
+    """Endpoint to get one summary of what the capture and encode pipeline is actually doing"""
+    return web.json_response(pipeline_report(), dumps=lambda data: json.dumps(data, default=str))
+
 async def handle_camera_info(request):
     """Endpoint to get camera information"""
     global camera_obj
@@ -304,6 +2478,8 @@ async def handle_camera_info(request):
     try:
         info = {
             "status": "running",
+            "stream_name": node_config.stream_name,
+            "output_size": list(get_output_size()),
             "properties": camera_obj.camera_properties,
             "config": str(camera_obj.camera_config),
             "controls": str(camera_obj.camera_controls),
@@ -313,6 +2489,248 @@ async def handle_camera_info(request):
         logger.error(f"Error getting camera info: {e}")
         return web.Response(status=500, text=f"Error getting camera info: {e}")
 
+async def handle_device(request):
+    """Endpoint identifying the physical capture device behind the stream"""
+    if not camera_obj:
+        return web.Response(status=500, text="Camera not initialized")
+    
+    kind, target = parse_source(node_config.source)
+    info = {"source": node_config.source, "kind": kind, "model": camera_obj.camera_properties.get("Model")}
+    if kind == "v4l2":
+        info["v4l2"] = camera_obj.device_info
+    elif kind == "camera":
+        info["properties"] = camera_obj.camera_properties
+    return web.json_response(info, dumps=lambda data: json.dumps(data, default=str))
+
+async def handle_mjpeg(request):
+    """Multipart MJPEG stream of the capture, usable directly as an <img> src"""
+    if mjpeg_streamer is None:
+        return web.Response(status=500, text="Camera not initialized")
+    
+    response = web.StreamResponse(headers={
+        "Content-Type": "multipart/x-mixed-replace; boundary=frame",
+        "Cache-Control": "no-cache"
+    })
+    await response.prepare(request)
+    set_stream_keepalive(request)
+    
+    mjpeg_streamer.attach()
+    audit = {"session_id": uuid.uuid4().hex[:8], "remote": request.remote, "path": request.path, "transport": "mjpeg"}
+    audit_log.record("play", **audit)
+    try:
+        sequence = 0
+        while True:
+            sequence, jpeg = await mjpeg_streamer.next_jpeg(sequence)
+            await write_stream(response, b"--frame\r\nContent-Type: image/jpeg\r\n"
+                               + f"Content-Length: {len(jpeg)}\r\n\r\n".encode() + jpeg + b"\r\n")
+    except asyncio.TimeoutError:
+        logger.info(f"MJPEG client {request.remote} stopped reading, closing it")
+    except (ConnectionResetError, asyncio.CancelledError):
+        pass
+    finally:
+        mjpeg_streamer.detach()
+        audit_log.record("teardown", **audit)
+    return response
+
+async def handle_tracking(request):
+    """Multipart stream of small grayscale PGM frames for the tracking consumer"""
+    if tracking_feed is None:
+        return web.Response(status=500, text="Camera not initialized")
+    
+    response = web.StreamResponse(headers={
+        "Content-Type": "multipart/x-mixed-replace; boundary=frame",
+        "Cache-Control": "no-cache"
+    })
+    await response.prepare(request)
+    set_stream_keepalive(request)
+    
+    tracking_feed.attach()
+    audit = {"session_id": uuid.uuid4().hex[:8], "remote": request.remote, "path": request.path, "transport": "tracking"}
+    audit_log.record("play", **audit)
+    try:
+        sequence = 0
+        while True:
+            sequence, image = await tracking_feed.next_jpeg(sequence)
+            await write_stream(response, b"--frame\r\nContent-Type: image/x-portable-graymap\r\n"
+                               + f"Content-Length: {len(image)}\r\n\r\n".encode() + image + b"\r\n")
+    except asyncio.TimeoutError:
+        logger.info(f"Tracking client {request.remote} stopped reading, closing it")
+    except (ConnectionResetError, asyncio.CancelledError):
+        pass
+    finally:
+        tracking_feed.detach()
+        audit_log.record("teardown", **audit)
+    return response
+
+async def handle_snapshot(request):
+    """Still JPEG of a recent frame, shared between every polling client"""
+    if snapshot_cache is None:
+        return web.Response(status=500, text="Camera not initialized")
+    
+    try:
+        snapshot = await snapshot_cache.get()
+    except (cv2.error, ValueError) as e:
+        logger.error(f"Could not encode snapshot: {e}")
+        return web.Response(status=500, text=f"Could not encode snapshot: {e}")
+    if snapshot is None:
+        return web.Response(status=503, text="No frame captured yet")
+    
+    jpeg, captured_at = snapshot
+    return web.Response(body=jpeg, content_type="image/jpeg", headers={
+        "Cache-Control": "no-cache",
+        "X-Capture-Time": f"{captured_at:.3f}"
+    })
+
+async def handle_replay(request):
+    """Endpoint to get a clip of the last few seconds as a fragmented MP4.
+
+    offset is how many seconds back the clip starts (default: the whole buffer) and duration
+    how long it runs (default: up to now).
+    """
+    if replay_buffer is None:
+        return web.Response(status=404, text="Replay buffer is disabled (set replay_seconds)")
+    
+    try:
+        offset = float(request.query.get("offset", replay_buffer.available_seconds))
+        duration = request.query.get("duration")
+        duration = float(duration) if duration is not None else None
+        if offset <= 0 or (duration is not None and duration <= 0):
+            raise ValueError("offset and duration must be positive")
+    except ValueError as e:
+        return web.Response(status=400, text=f"Invalid replay request: {e}")
+    
+    try:
+        clip = await asyncio.get_event_loop().run_in_executor(None, replay_buffer.clip, offset, duration)
+    except LookupError as e:
+        return web.Response(status=404, text=f"No replay available: {e}")
+    except Exception as e:
+        logger.error(f"Error building replay clip: {e}")
+        return web.Response(status=500, text=f"Error building replay clip: {e}")
+    
+    name = time.strftime("replay-%Y%m%d-%H%M%S.mp4")
+    return web.Response(body=clip, content_type="video/mp4",
+                        headers={"Content-Disposition": f'inline; filename="{name}"'})
+
+async def handle_framerate(request):
+    """API endpoint to set or clear the soft frame rate cap ({"max_fps": null} clears it)"""
+    try:
+        params = await request.json()
+        max_fps = params.get("max_fps")
+        if max_fps is not None:
+            max_fps = int(max_fps)
+            if max_fps <= 0:
+                raise ValueError("max_fps must be greater than 0")
+    except (TypeError, ValueError) as e:
+        return web.Response(status=400, text=f"Invalid frame rate cap: {e}")
+    
+    frame_rate_limiter.manual_cap = max_fps
+    logger.info(f"Soft frame rate cap {'set to ' + str(max_fps) + ' fps' if max_fps else 'cleared'}")
+    return await handle_framerate_state(request)
+
+async def handle_framerate_state(request):
+    """Endpoint to get the camera frame rate and any soft caps in effect"""
+    return web.json_response({
+        "camera_fps": node_config.framerate,
+        "manual_cap": frame_rate_limiter.manual_cap,
+        "thermal_cap": thermal_monitor.fps_cap,
+        "max_fps": frame_rate_limiter.max_fps
+    })
+
+async def handle_healthz(request):
+    """Readiness probe: 200 once the node is serving frames, 503 before that"""
+    return web.json_response({
+        "ready": node_ready,
+        "state": pipeline_state,
+        "restarts": len(restart_times),
+        "maintenance": maintenance_mode,
+        "camera_error": None if camera_error is None else {"category": camera_error.category,
+                                                           "message": str(camera_error.cause),
+                                                           "hint": camera_error.hint}
+    }, status=200 if node_ready else 503)
+
+async def handle_maintenance(request):
+    """API endpoint to put the camera into or out of maintenance mode, e.g. {"enabled": true}"""
+    try:
+        params = await request.json()
+        enabled = params["enabled"]
+        if not isinstance(enabled, bool):
+            raise ValueError("enabled must be true or false")
+    except (KeyError, ValueError) as e:
+        return web.Response(status=400, text=f"Invalid maintenance request: {e}")
+    
+    if not await set_maintenance_mode(enabled):
+        return web.Response(status=500, text="Camera could not be opened, see the node log")
+    return web.json_response({"maintenance": maintenance_mode})
+
+async def handle_stats(request):
+    """Endpoint to get streaming and image statistics"""
+    return web.json_response({
+        "active_connections": len(pcs),
+        "active_tracks": len(active_tracks),
+        "exposure": exposure_monitor.health,
+        "latency": pipeline_stats.latency_summary(),
+        "counters": dict(pipeline_stats.counters),
+        "publishing": None if publisher is None else publisher.connected,
+        "publish_failed": None if publisher is None else publisher.failed,
+        "thermal": thermal_monitor.status,
+        "sessions": {session_id: {"remote": session["remote"], "ssrc": session["ssrc"],
+                                  "loss": {kind: loss_estimate(reports)
+                                           for kind, reports in session["receiver_reports"].items()},
+                                  "gop": {kind: track.bitstream.gop_position if track.bitstream else None
+                                          for kind, track in session["tracks"].items()}}
+                     for session_id, session in sessions.items()}
+    })
+
+async def handle_sessions(request):
+    """Endpoint to list sessions with whether each viewer is receiving, judged from its RTCP reports"""
+    return web.json_response({
+        session_id: {
+            "remote": session["remote"],
+            "state": session["pc"].connectionState,
+            "tracks": {kind: {"ssrc": session["ssrc"][kind], "paused": track.paused,
+                              **receiver_report_status(session["receiver_reports"][kind], track.paused),
+                              "counters": session_stats(session)[kind]}
+                       for kind, track in session["tracks"].items()},
+            "stats_since": session["stats_since"],
+        }
+        for session_id, session in sessions.items()
+    })
+
+def collect_metrics():
+    """Gauges and cumulative counters pushed to StatsD, matching what /stats reports"""
+    gauges = {
+        "sessions": len(pcs),
+        "tracks": len(active_tracks),
+        "mjpeg_clients": mjpeg_streamer.clients if mjpeg_streamer else 0,
+        "temperature_c": thermal_monitor.status["temperature_c"],
+        "ready": int(node_ready),
+    }
+    for stage, summary in pipeline_stats.latency_summary().items():
+        if summary:
+            gauges[f"latency.{stage}.avg_ms"] = summary["avg_ms"]
+            gauges[f"latency.{stage}.p95_ms"] = summary["p95_ms"]
+    for control, value in control_events.gauges.items():
+        gauges[f"control.{control}"] = value
+    counters = dict(pipeline_stats.counters)
+    counters["frames"] = frame_hub.sequence if frame_hub else 0
+    return gauges, counters
+
+def prometheus_name(name):
+    """Prometheus metric name for a dotted metric name"""
+    return "followspot_" + "".join(char if char.isalnum() else "_" for char in name)
+
+async def handle_metrics(request):
+    """Prometheus text exposition of the same gauges and counters pushed to StatsD"""
+    gauges, counters = collect_metrics()
+    lines = []
+    for name, value in sorted(gauges.items()):
+        if value is None:
+            continue
+        lines += [f"# TYPE {prometheus_name(name)} gauge", f"{prometheus_name(name)} {value}"]
+    for name, total in sorted(counters.items()):
+        lines += [f"# TYPE {prometheus_name(name)}_total counter", f"{prometheus_name(name)}_total {total}"]
+    return web.Response(text="\n".join(lines) + "\n", content_type="text/plain")
+
 async def on_server_shutdown(app):
     """Cleanup when server shuts down"""
     # Stop all tracks first
@@ -330,49 +2748,526 @@ async def on_server_shutdown(app):
     
     pcs.clear()
     
+    for source in control_sources:
+        try:
+            await source.stop()
+        except Exception as e:
+            logger.warning(f"Error stopping control source {source.name}: {e}")
+    
+    audit_log.close()
+    
+    # Stop capturing before the camera goes away
+    for task in (archive_task, publish_task, replay_task):
+        if not task:
+            continue
+        task.cancel()
+        try:
+            await task
+        except asyncio.CancelledError:
+            pass
+    if frame_hub:
+        await frame_hub.stop()
+    
     # Stop the camera
     if camera_obj:
         camera_obj.stop()
         camera_obj.close()
         logger.info("Camera stopped and closed")
 
+def format_sensor_mode(mode):
+    """One-line description of a Picamera2 sensor mode"""
+    width, height = mode["size"]
+    crop = mode.get("crop_limits")
+    crop_desc = f" crop={crop[2]}x{crop[3]}+{crop[0]}+{crop[1]}" if crop else ""
+    return f"{width}x{height} {mode['bit_depth']}-bit {mode.get('fps', 0):.1f} fps{crop_desc}"
+
+def list_devices():
+    """Print the cameras with their sensor modes, and the V4L2 capture devices"""
+    if Picamera2 is None:
+        print("Cameras: picamera2 is not installed")
+    else:
+        cameras = Picamera2.global_camera_info()
+        print(f"Cameras: {len(cameras)}")
+        for index, info in enumerate(cameras):
+            print(f"  camera:{index}  {info.get('Model', 'unknown')}  {info.get('Id', '')}")
+            try:
+                camera = Picamera2(index)
+            except Exception as e:
+                print(f"    could not open: {e}")
+                continue
+            try:
+                # A sensor mode is the raw format the sensor reads out: a full-frame mode for
+                # resolution, or a cropped/binned one for frame rate
+                for mode_index, mode in enumerate(camera.sensor_modes):
+                    print(f"    sensor_mode {mode_index}: {format_sensor_mode(mode)}")
+            finally:
+                camera.close()
+    
+    devices = sorted(name for name in os.listdir("/sys/class/video4linux")
+                     if name.startswith("video")) if os.path.isdir("/sys/class/video4linux") else []
+    print(f"V4L2 devices: {len(devices)}")
+    for name in devices:
+        device = f"/dev/{name}"
+        caps = v4l2_query_capabilities(device)
+        if caps is None:
+            print(f"  v4l2:{device}  {v4l2_device_name(device) or 'unknown'}")
+        elif "video_capture" in (caps["device_capabilities"] or caps["capabilities"]):
+            print(f"  v4l2:{device}  {caps['card']} ({caps['driver']}, {caps['bus_info']})")
+            try:
+                inputs = v4l2_list_inputs(device)
+            except OSError:
+                inputs = []
+            if len(inputs) > 1:
+                for item in inputs:
+                    status = f"  ({', '.join(item['status'])})" if item["status"] else ""
+                    print(f"    input {item['index']}: {item['name']}{status}")
+
+def dry_run(host, port):
+    """Check the camera and network setup without streaming.
+
+    Returns a list of problems found; an empty list means the node is ready to serve.
+    """
+    problems = []
+    
+    # Confirm the port can be bound before touching the camera
+    bind_desc = format_address(host or "*", port)
+    try:
+        check_bind(host, port, node_config.reuse_port)
+        logger.info(f"Dry run: able to bind {bind_desc}")
+    except OSError as e:
+        problems.append(describe_bind_failure(host, port, e))
+    
+    camera = init_camera()
+    if not camera:
+        problems.append("camera could not be initialized")
+        return problems
+    
+    frame = None
+    try:
+        frame = camera.capture_array("main")
+        # The same geometry check every streamed frame goes through
+        FrameHub(camera, capture_size, frame_pipeline, pipeline_stats,
+                 max_frame_bytes=node_config.max_frame_bytes).check_complete(frame)
+        logger.info(f"Dry run: captured a frame of shape {frame.shape}")
+    except IncompleteFrameError as e:
+        problems.append(f"camera returned an unusable frame: {e}")
+        frame = None
+    except Exception as e:
+        problems.append(f"could not capture a frame: {e}")
+        frame = None
+    finally:
+        camera.stop()
+        camera.close()
+    
+    if frame is not None:
+        problems += check_parameter_sets(frame)
+    return problems
+
+def check_parameter_sets(array):
+    """Encode one frame with H.264 as a session would and check the SPS and PPS come out.
+
+    Returns a list of problems, e.g. libx264 missing from the FFmpeg build.
+    """
+    codec, options = BENCHMARK_ENCODERS["h264"]
+    try:
+        encoder = av.CodecContext.create(codec, "w")
+        encoder.width, encoder.height = array.shape[1], array.shape[0] * 2 // 3
+        encoder.pix_fmt = "yuv420p"
+        encoder.time_base = fractions.Fraction(1, node_config.framerate)
+        encoder.options = options
+        frame = VideoFrame.from_ndarray(array, format="yuv420p")
+        frame.pts = 0
+        # Flushing makes the encoder give up the frame it would otherwise hold for lookahead
+        packets = encoder.encode(frame) + encoder.encode(None)
+    except Exception as e:
+        return [f"could not encode a frame with {codec}: {e}"]
+    
+    kinds = {nal_type(unit) for packet in packets for unit in split_annexb(bytes(packet))}
+    missing = [name for kind, name in ((NAL_SPS, "SPS"), (NAL_PPS, "PPS")) if kind not in kinds]
+    if missing:
+        return [f"{codec} produced no {' or '.join(missing)} for a captured frame"]
+    logger.info(f"Dry run: encoded a frame with {codec}, found the SPS and PPS")
+    return []
+
+def benchmark_mode(size, framerate):
+    """Capture and encode at one resolution and frame rate.
+
+    Returns the achieved capture rate and per-encoder frame encode times in seconds.
+    """
+    global capture_size
+    capture_size = size
+    node_config.framerate = framerate
+    camera = init_camera()
+    if not camera:
+        raise RuntimeError("camera could not be initialized")
+    
+    encoders = {}
+    for name, (codec, options) in BENCHMARK_ENCODERS.items():
+        encoder = av.CodecContext.create(codec, "w")
+        encoder.width, encoder.height = size
+        encoder.pix_fmt = "yuv420p"
+        encoder.time_base = fractions.Fraction(1, framerate)
+        encoder.options = options
+        encoders[name] = encoder
+    encode_times = {name: [] for name in encoders}
+    
+    frames = 0
+    try:
+        start = time.monotonic()
+        while time.monotonic() - start < BENCHMARK_SECONDS:
+            array = camera.capture_array("main")
+            frame = VideoFrame.from_ndarray(array, format="yuv420p")
+            frame.pts = frames
+            frames += 1
+            for name, encoder in encoders.items():
+                encode_start = time.monotonic()
+                encoder.encode(frame)
+                encode_times[name].append(time.monotonic() - encode_start)
+        elapsed = time.monotonic() - start
+    finally:
+        camera.stop()
+        camera.close()
+    
+    return frames / elapsed, encode_times
+
+def run_benchmark():
+    """Step through BENCHMARK_MODES and print what this camera and Pi can sustain in real time.
+
+    A mode is sustainable when the camera delivers at least 90% of the requested frame rate and
+    every encoder keeps up with it while running alongside capture.
+    """
+    rows = []
+    for size, framerate in BENCHMARK_MODES:
+        label = f"{size[0]}x{size[1]} @ {framerate}"
+        logger.info(f"Benchmarking {label}")
+        try:
+            capture_fps, encode_times = benchmark_mode(size, framerate)
+        except Exception as e:
+            logger.warning(f"Benchmark of {label} failed: {e}")
+            rows.append((label, "failed", {}, False))
+            continue
+        
+        interval = 1.0 / framerate
+        encode_ms = {}
+        sustainable = capture_fps >= framerate * 0.9
+        for name, times in encode_times.items():
+            if not times:
+                sustainable = False
+                continue
+            mean = statistics.mean(times)
+            p95 = sorted(times)[int(len(times) * 0.95) - 1] if len(times) >= 20 else max(times)
+            encode_ms[name] = f"{mean * 1000:.1f}/{p95 * 1000:.1f}"
+            sustainable = sustainable and mean < interval
+        rows.append((label, f"{capture_fps:.1f}", encode_ms, sustainable))
+    
+    encoder_names = list(BENCHMARK_ENCODERS)
+    header = ["mode", "capture fps"] + [f"{name} ms mean/p95" for name in encoder_names] + ["sustainable"]
+    table = [header] + [
+        [label, capture] + [encode_ms.get(name, "-") for name in encoder_names] + ["yes" if ok else "no"]
+        for label, capture, encode_ms, ok in rows
+    ]
+    widths = [max(len(row[column]) for row in table) for column in range(len(header))]
+    for row in table:
+        print("  ".join(cell.ljust(width) for cell, width in zip(row, widths)))
+    
+    # Sliced encoder threads trade CPU against latency; show where more stop paying off
+    print()
+    print(f"H.264 encode at {BENCHMARK_THREADS_SIZE[0]}x{BENCHMARK_THREADS_SIZE[1]}, ms per frame by encoder_threads")
+    for threads in range(1, (os.cpu_count() or 1) + 1):
+        print(f"  {threads}: {benchmark_encoder_threads(threads):.1f}")
+    
+    # YUYV capture devices need a conversion before encoding; compare the yuyv_conversion choices
+    print()
+    print("YUYV to I420 and NV12 conversion, ms per frame (swscale / numpy)")
+    for size in sorted({size for size, _ in BENCHMARK_MODES}):
+        timings = [f"{swscale_ms:.2f} / {numpy_ms:.2f}" for swscale_ms, numpy_ms in
+                   (benchmark_yuyv_conversion(size, pixel_format) for pixel_format in ENCODER_PIXEL_FORMATS)]
+        print(f"  {size[0]}x{size[1]}: I420 {timings[0]}, NV12 {timings[1]}")
+    return rows
+
+def benchmark_encoder_threads(threads):
+    """Time encoding noise frames with libx264 on this many threads, in milliseconds per frame.
+
+    Noise is the encoder's worst case, so real scenes encode faster; the ratios still hold.
+    """
+    width, height = BENCHMARK_THREADS_SIZE
+    encoder = av.CodecContext.create("libx264", "w")
+    encoder.width, encoder.height = width, height
+    encoder.pix_fmt = "yuv420p"
+    encoder.time_base = fractions.Fraction(1, 30)
+    encoder.thread_count = threads
+    encoder.options = BENCHMARK_ENCODERS["h264"][1]
+    
+    elapsed = 0.0
+    for index in range(BENCHMARK_THREAD_FRAMES):
+        array = np.random.randint(0, 256, (height * 3 // 2, width), dtype=np.uint8)
+        frame = VideoFrame.from_ndarray(array, format="yuv420p")
+        frame.pts = index
+        start = time.monotonic()
+        encoder.encode(frame)
+        elapsed += time.monotonic() - start
+    return elapsed * 1000 / BENCHMARK_THREAD_FRAMES
+
+def benchmark_yuyv_conversion(size, pixel_format="yuv420p"):
+    """Time converting a YUYV frame of this size to I420 or NV12 with swscale and with numpy, in milliseconds"""
+    width, height = size
+    frame = VideoFrame(width, height, "yuyv422")
+    packed = frame.to_ndarray()
+    convert = yuyv_to_nv12 if pixel_format == "nv12" else yuyv_to_i420
+    
+    start = time.monotonic()
+    for _ in range(BENCHMARK_CONVERSIONS):
+        # Planes stay in the frame, as when swscale feeds an encoder
+        frame.reformat(width=width, height=height, format=pixel_format)
+    swscale_ms = (time.monotonic() - start) * 1000 / BENCHMARK_CONVERSIONS
+    
+    start = time.monotonic()
+    for _ in range(BENCHMARK_CONVERSIONS):
+        convert(packed)
+    numpy_ms = (time.monotonic() - start) * 1000 / BENCHMARK_CONVERSIONS
+    return swscale_ms, numpy_ms
+
+def run_latency_test():
+    """Time the node's own share of the latency per frame and print it by stage.
+
+    Frames go from the configured source through the frame pipeline, a session-like H.264
+    encoder and a decoder standing in for the client. A file: source makes the runs repeatable.
+    """
+    camera = init_camera()
+    if not camera:
+        logger.error("Failed to initialize camera, exiting")
+        return False
+    logger.info(f"Measuring pipeline latency from {node_config.source} for {LATENCY_TEST_SECONDS:.0f}s")
+    try:
+        times = measure_pipeline_latency(camera, frame_pipeline, node_config.framerate, LATENCY_TEST_SECONDS,
+                                         BENCHMARK_ENCODERS["h264"][1])
+    finally:
+        camera.stop()
+        camera.close()
+    
+    if not times["total"]:
+        logger.error("No frame made it through the pipeline")
+        return False
+    print(f"Pipeline latency over {len(times['total'])} frames, ms (capture to decoded frame)")
+    print(f"  {'stage':<8}  {'mean':>6}  {'p50':>6}  {'p95':>6}  {'max':>6}")
+    for stage, values in times.items():
+        ordered = sorted(values)
+        p95 = ordered[int(len(ordered) * 0.95) - 1] if len(ordered) >= 20 else ordered[-1]
+        print(f"  {stage:<8}  {statistics.mean(values) * 1000:6.1f}  {statistics.median(values) * 1000:6.1f}  "
+              f"{p95 * 1000:6.1f}  {ordered[-1] * 1000:6.1f}")
+    return True
+
+async def run_to_stdout():
+    """Write the capture to stdout as an Annex-B H.264 elementary stream, without the HTTP server.
+
+    Runs until the reader goes away, e.g. `server.py --to-stdout | ffplay -`. Logging already goes
+    to stderr, so stdout carries nothing but video.
+    """
+    global frame_hub, publisher
+    
+    if not init_camera():
+        logger.error("Failed to initialize camera, exiting")
+        return False
+    
+    frame_hub = FrameHub(camera_obj, capture_size, frame_pipeline, pipeline_stats,
+                         warmup_frames=node_config.warmup_frames,
+                         capture_timeout=node_config.camera_timeout,
+                         max_frame_bytes=node_config.max_frame_bytes)
+    frame_hub.start()
+    # A closed pipe won't come back, so the first write failure ends the run
+    publisher = StreamPublisher(frame_hub, "pipe:1", get_output_size(),
+                                fps=node_config.framerate,
+                                codec=node_config.publish_codec,
+                                bitrate=node_config.publish_bitrate,
+                                color_range=node_config.color_range,
+                                reconnect_max_attempts=1,
+                                format="h264",
+                                pixel_format=node_config.publish_pixel_format)
+    try:
+        await publisher.run()
+    finally:
+        await frame_hub.stop()
+        camera_obj.stop()
+        camera_obj.close()
+    return True
+
 async def run_server(host, port):
     """Set up and run the web server"""
+    global frame_hub, archive_task, publisher, publish_task, replay_buffer, replay_task, mjpeg_streamer
+    global snapshot_cache, tracking_feed, server_stop, pipeline_state
+    
+    server_stop = asyncio.Event()
+    log_stream.attach(asyncio.get_running_loop())
+    
     # Initialize the camera
-    if not init_picamera():
-        logger.error("Failed to initialize camera, exiting")
-        return
+    if not init_camera():
+        if not node_config.auto_restart:
+            logger.error("Failed to initialize camera, exiting")
+            return
+        logger.error("Failed to initialize camera, the supervisor will keep retrying")
+    
+    # One capture loop feeds every client and recorder
+    frame_hub = FrameHub(camera_obj, capture_size, frame_pipeline, pipeline_stats,
+                         warmup_frames=node_config.warmup_frames,
+                         capture_timeout=node_config.camera_timeout,
+                         max_frame_bytes=node_config.max_frame_bytes)
+    if camera_obj:
+        frame_hub.start()
+        asyncio.ensure_future(watch_first_frame())
+    mjpeg_streamer = MjpegStreamer(frame_hub, fps=node_config.mjpeg_fps, quality=node_config.mjpeg_quality)
+    snapshot_cache = SnapshotCache(frame_hub, max_fps=node_config.snapshot_fps, quality=node_config.mjpeg_quality)
+    tracking_feed = TrackingFeed(frame_hub, size=tuple(node_config.tracking_size), fps=node_config.tracking_fps)
+    
+    if node_config.archive_dir:
+        recorder = ArchiveRecorder(frame_hub, node_config.archive_dir, get_output_size(),
+                                   fps=node_config.archive_fps,
+                                   segment_seconds=node_config.archive_segment_seconds,
+                                   max_segments=node_config.archive_max_segments,
+                                   codec=node_config.archive_codec,
+                                   bitrate=node_config.archive_bitrate,
+                                   color_range=node_config.color_range)
+        archive_task = asyncio.ensure_future(recorder.run())
+    
+    if node_config.publish_url:
+        publisher = StreamPublisher(frame_hub, node_config.publish_url, get_output_size(),
+                                    fps=node_config.framerate,
+                                    codec=node_config.publish_codec,
+                                    bitrate=node_config.publish_bitrate,
+                                    color_range=node_config.color_range,
+                                    reconnect_initial_delay=node_config.reconnect_initial_delay,
+                                    reconnect_max_delay=node_config.reconnect_max_delay,
+                                    reconnect_max_attempts=node_config.reconnect_max_attempts,
+                                    pixel_format=node_config.publish_pixel_format)
+        publish_task = asyncio.ensure_future(publisher.run())
+    
+    if node_config.replay_seconds:
+        replay_buffer = ReplayBuffer(frame_hub, get_output_size(),
+                                     seconds=node_config.replay_seconds,
+                                     fps=node_config.replay_fps,
+                                     bitrate=node_config.replay_bitrate,
+                                     color_range=node_config.color_range)
+        replay_task = asyncio.ensure_future(replay_buffer.run())
     
     # Set up web server
-    app = web.Application()
+    middlewares = []
+    if node_config.auth_users:
+        authorizer = PathAuthorizer(node_config.auth_users, node_config.auth_paths, node_config.auth_realm)
+        middlewares.append(authorizer.middleware)
+        logger.info(f"HTTP basic auth enabled for {len(node_config.auth_users)} users, "
+                    f"{len(authorizer.paths)} path rules")
+    app = web.Application(middlewares=middlewares)
+    app["listen"] = (host, port)
     app.on_shutdown.append(on_server_shutdown)
     
     # Define routes
     app.router.add_post("/offer", handle_offer)
+    app.router.add_get("/sessions", handle_sessions)
+    app.router.add_post("/sessions/{session_id}/pause", handle_session_pause)
+    app.router.add_post("/sessions/{session_id}/reset-stats", handle_session_reset_stats)
+    app.router.add_post("/sessions/reset-stats", handle_sessions_reset_stats)
+    app.router.add_post("/keyframe", handle_keyframe)
     app.router.add_post("/focus", handle_focus)
+    app.router.add_get("/focus", handle_focus_state)
+    app.router.add_get("/events", handle_events)
+    app.router.add_get("/logs", handle_logs)
+    app.router.add_post("/ir", handle_ir_mode)
+    app.router.add_post("/ircut", handle_ir_cut)
+    app.router.add_get("/exposure", handle_exposure_state)
+    app.router.add_post("/exposure", handle_exposure)
+    app.router.add_get("/ircut", handle_ir_cut_state)
+    app.router.add_get("/inputs", handle_inputs)
+    app.router.add_post("/inputs", handle_input_select)
+    app.router.add_get("/controls", handle_controls)
+    app.router.add_post("/controls/refresh", handle_controls_refresh)
+    app.router.add_post("/controls/reset", handle_controls_reset)
+    app.router.add_get("/presets", handle_presets)
+    app.router.add_post("/presets/{name}", handle_preset_save)
+    app.router.add_delete("/presets/{name}", handle_preset_delete)
+    app.router.add_post("/presets/{name}/recall", handle_preset_recall)
     app.router.add_get("/camera/info", handle_camera_info)
+    app.router.add_get("/device", handle_device)
+    app.router.add_get("/stats", handle_stats)
+    app.router.add_get("/metrics", handle_metrics)
+    app.router.add_get("/config", handle_config)
+    app.router.add_get("/pipeline", handle_pipeline)
+    app.router.add_get("/healthz", handle_healthz)
+    app.router.add_post("/maintenance", handle_maintenance)
+    app.router.add_post("/framerate", handle_framerate)
+    app.router.add_get("/framerate", handle_framerate_state)
+    app.router.add_get("/replay", handle_replay)
+    app.router.add_get("/mjpeg", handle_mjpeg)
+    app.router.add_get("/snapshot", handle_snapshot)
+    app.router.add_get("/tracking", handle_tracking)
     
     # Add simple root endpoint
     async def handle_root(request):
+        if node_config.stream_name:
+            return web.Response(text=f"WebRTC Camera Server Running: {node_config.stream_name}")
         return web.Response(text="WebRTC Camera Server Running")
     app.router.add_get("/", handle_root)
     
     # Start the server
     runner = web.AppRunner(app)
     await runner.setup()
-    site = web.TCPSite(runner, host, port)
-    await site.start()
+    # SO_REUSEADDR lets a restart rebind while the old run's connections sit in TIME_WAIT. With
+    # SO_REUSEPORT a live server would share the port silently, so check for one first
+    if node_config.reuse_port and find_listener(host, port):
+        logger.error(f"Another process is already serving on {format_address(host or '*', port)}, "
+                     f"refusing to share the port with it")
+        pipeline_state = "failed"
+        await runner.cleanup()
+        return
+    site = web.TCPSite(runner, host, port, reuse_address=True, reuse_port=node_config.reuse_port)
+    try:
+        await site.start()
+    except OSError as e:
+        logger.error(describe_bind_failure(host, port, e))
+        pipeline_state = "failed"
+        await runner.cleanup()
+        return
     
-    server_ip = get_ip_address()
-    logger.info(f"WebRTC Signaling Server running on http://{server_ip}:{port}")
+    audit_log.path = node_config.audit_log
+    audit_log.open()
+    control_presets.path = node_config.state_file
+    control_presets.load()
     
-    # Keep the server running
-    while True:
+    for source in control_sources:
         try:
-            await asyncio.sleep(3600)  # Sleep for an hour
-        except KeyboardInterrupt:
-            logger.info("Keyboard interrupt received, shutting down.")
-            break
+            await source.start()
+        except Exception as e:
+            # One broken protocol shouldn't take the camera off the air
+            logger.error(f"Could not start control source {source.name}: {e}")
+    
+    # SIGHUP re-reads the config, e.g. to point the node at a swapped camera
+    asyncio.get_event_loop().add_signal_handler(signal.SIGHUP, lambda: asyncio.ensure_future(reload_config()))
+    
+    asyncio.ensure_future(focus_monitor())
+    asyncio.ensure_future(thermal_monitor.run())
+    if node_config.remote_config_url:
+        asyncio.ensure_future(watch_remote_config())
+    if node_config.auto_restart:
+        asyncio.ensure_future(supervise_pipeline())
+    if node_config.metrics_push_url:
+        prefix = node_config.metrics_prefix or f"followspot.{socket.gethostname()}"
+        pusher = StatsdPusher(node_config.metrics_push_url, prefix, collect_metrics,
+                              interval=node_config.metrics_push_interval)
+        asyncio.ensure_future(pusher.run())
+    
+    for address in runner.addresses:
+        logger.info(f"Listening on {format_address(address[0], address[1])}")
+    
+    if host is None or host == "0.0.0.0":
+        server_ip = get_ip_address()
+    elif host == "::":
+        server_ip = get_ip_address(socket.AF_INET6)
+    else:
+        server_ip = host
+    server_url = f"http://{format_address(server_ip, port)}"
+    logger.info(f"WebRTC Signaling Server running on {server_url}")
+    asyncio.ensure_future(announce_ready(server_url))
+    
+    # Keep the server running until shut down or the supervisor gives up
+    await server_stop.wait()
     
     # Cleanup
     await runner.cleanup()
@@ -382,13 +3277,116 @@ if __name__ == "__main__":
     import argparse
     
     parser = argparse.ArgumentParser(description="WebRTC Camera Server")
-    parser.add_argument("--host", default="0.0.0.0", help="Host to bind server to")
+    parser.add_argument("--host", default=None,
+                        help="Address to bind server to (default: bind_address from the node config)")
     parser.add_argument("--port", type=int, default=8080, help="Port to bind server to")
+    parser.add_argument("--config", default=DEFAULT_CONFIG_PATH,
+                        help="Node configuration file (default: ../config/node_config.json)")
+    parser.add_argument("--dry-run", action="store_true",
+                        help="Validate the configuration, camera and port, then exit without streaming")
+    parser.add_argument("--verbose", action="store_true",
+                        help="Log at debug level and log a summary of the running pipeline once ready")
+    parser.add_argument("--print-config", action="store_true",
+                        help="Print the fully resolved configuration as JSON and exit")
+    parser.add_argument("--maintenance", action="store_true",
+                        help="Start in maintenance mode: leave the camera closed and stream a placeholder")
+    parser.add_argument("--list-devices", action="store_true",
+                        help="List the cameras with their sensor modes and the V4L2 capture devices, then exit")
+    parser.add_argument("--to-stdout", action="store_true",
+                        help="Write raw Annex-B H.264 to stdout instead of serving, e.g. for piping into ffplay -")
+    parser.add_argument("--benchmark", action="store_true",
+                        help="Measure which resolutions and frame rates this hardware sustains, then exit")
+    parser.add_argument("--latency-test", action="store_true",
+                        help="Time capture-to-decode latency through the pipeline per stage, then exit")
+    preset_group = parser.add_mutually_exclusive_group()
+    preset_group.add_argument("--low-latency", dest="preset", action="store_const", const="low-latency",
+                              help="Tune for minimum latency (tracking); config settings still override")
+    preset_group.add_argument("--quality", dest="preset", action="store_const", const="quality",
+                              help="Tune for image quality (recording); config settings still override")
     args = parser.parse_args()
     
+    if args.list_devices:
+        list_devices()
+        raise SystemExit(0)
+    
+    config_path = args.config
+    config_preset = args.preset
+    verbose = args.verbose
+    if verbose:
+        logging.getLogger().setLevel(logging.DEBUG)
+    maintenance_mode = args.maintenance
+    
+    try:
+        node_config = load_node_config(args.config, preset=args.preset)
+    except (OSError, ValueError) as e:
+        logger.error(f"Could not load node configuration: {e}")
+        raise SystemExit(1)
+    
+    config_errors = node_config.validate()
+    if config_errors:
+        for error in config_errors:
+            logger.error(f"Invalid node configuration: {error}")
+        raise SystemExit(1)
+    
+    capture_size = tuple(node_config.resolution)
+    SampledLogger.interval = node_config.log_sample_interval
+    # Before any hook is installed, so a mismatched aiortc is reported once, up front
+    check_aiortc()
+    if node_config.encoder_threads:
+        set_encoder_threads(node_config.encoder_threads)
+    if node_config.abs_capture_time:
+        advertise_abs_capture_time()
+    thermal_monitor.cap_temperature = node_config.thermal_cap_temperature
+    thermal_monitor.cap_fps = node_config.thermal_cap_fps
+    
+    if node_config.color_range == "full":
+        # aiortc opens its encoders without range information, so WebRTC clients decode as limited
+        logger.warning("color_range is 'full': WebRTC clients assume limited range unless they are "
+                       "told otherwise, so dark levels may look crushed on the control stack")
+    
     try:
-        asyncio.run(run_server(args.host, args.port))
+        frame_pipeline = build_frame_pipeline()
+        logger.info(f"Frame pipeline: {' -> '.join(frame_pipeline.names) or '(empty)'}")
+        control_sources = build_control_sources()
+        logger.info(f"Control sources: {', '.join(source.name for source in control_sources)}")
+    except ValueError as e:
+        logger.error(f"Invalid node configuration: {e}")
+        raise SystemExit(1)
+    
+    host = resolve_bind_host(args.host or node_config.bind_address, node_config.network)
+    
+    if args.print_config:
+        print(json.dumps(effective_config(host, args.port), indent=2, default=str))
+        raise SystemExit(0)
+    
+    if args.benchmark:
+        run_benchmark()
+        raise SystemExit(0)
+    
+    if args.latency_test:
+        raise SystemExit(0 if run_latency_test() else 1)
+    
+    if args.dry_run:
+        problems = dry_run(host, args.port)
+        for problem in problems:
+            logger.error(f"Dry run failed: {problem}")
+        if not problems:
+            logger.info("Dry run passed")
+        raise SystemExit(1 if problems else 0)
+    
+    if args.to_stdout:
+        try:
+            started = asyncio.run(run_to_stdout())
+        except KeyboardInterrupt:
+            started = True
+        raise SystemExit(0 if started else 1)
+    
+    try:
+        asyncio.run(run_server(host, args.port))
     except KeyboardInterrupt:
         logger.info("Keyboard interrupt received, shutting down.")
     except Exception as e:
-        logger.error(f"Error running server: {e}")
\ No newline at end of file
+        logger.error(f"Error running server: {e}")
+    
+    if pipeline_state == "failed":
+        raise SystemExit(1)
\ No newline at end of file
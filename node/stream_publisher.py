@@ -0,0 +1,160 @@
+#!/usr/bin/env python3
+"""
+Stream Publisher
+Pushes the shared capture to an upstream media server (RTMP or RTSP) for remote viewers.
+"""
+
+import asyncio
+import fractions
+import logging
+import time
+
+import av
+from av import VideoFrame
+from av.error import FFmpegError
+
+from frame_processing import COLOR_RANGES, tag_color_range, i420_size, i420_to_nv12
+
+logger = logging.getLogger("stream_publisher")
+
+# Seconds to wait before the first reconnect after the upstream connection fails; each further
+# failed attempt doubles the wait up to the maximum
+RECONNECT_INITIAL_DELAY = 5.0
+RECONNECT_MAX_DELAY = 60.0
+
+# Muxer for each supported URL scheme
+PUBLISH_FORMATS = {
+    "rtmp://": "flv",
+    "rtmps://": "flv",
+    "rtsp://": "rtsp",
+}
+
+def publish_format(url):
+    """Return the muxer name for a publish URL, or raise ValueError for unsupported schemes"""
+    for prefix, format_name in PUBLISH_FORMATS.items():
+        if url.startswith(prefix):
+            return format_name
+    raise ValueError(f"Unsupported publish URL '{url}', expected rtmp:// or rtsp://")
+
+class StreamPublisher:
+    """Encodes frames from a FrameHub and pushes them to a single upstream URL.
+
+    aiortc's per-session encoders emit RTP payloads that can't be remuxed, so the publisher runs
+    its own encoder. Upstream failures only affect the publisher; local clients are unaffected.
+    """
+
+    def __init__(self, hub, url, size, fps=30, codec="libx264", bitrate=1000000, color_range="limited",
+                 reconnect_initial_delay=RECONNECT_INITIAL_DELAY, reconnect_max_delay=RECONNECT_MAX_DELAY,
+                 reconnect_max_attempts=0, format=None, pixel_format="yuv420p"):
+        self.hub = hub
+        self.url = url
+        # An explicit format allows targets without a URL scheme, e.g. "pipe:1" with "h264"
+        self.format = format or publish_format(url)
+        self.size = size
+        self.fps = fps
+        self.codec = codec
+        self.bitrate = bitrate
+        self.color_range = color_range
+        # Layout frames are handed to the encoder in, one of ENCODER_PIXEL_FORMATS
+        self.pixel_format = pixel_format
+        self.reconnect_initial_delay = reconnect_initial_delay
+        self.reconnect_max_delay = reconnect_max_delay
+        # 0 retries forever
+        self.reconnect_max_attempts = reconnect_max_attempts
+        self.connected = False
+        # Set once reconnect_max_attempts consecutive attempts have failed and the publisher stops
+        self.failed = False
+        self._container = None
+        self._stream = None
+        self._start = 0.0
+        self._last_pts = -1
+
+    async def run(self):
+        loop = asyncio.get_event_loop()
+        sequence = 0
+        failures = 0
+        try:
+            while True:
+                try:
+                    await loop.run_in_executor(None, self._connect)
+                    while True:
+                        captured = await self.hub.next_frame(sequence)
+                        sequence = captured.sequence
+                        await loop.run_in_executor(None, self._write, captured)
+                        # Only a connection that carried frames resets the backoff
+                        failures = 0
+                except (FFmpegError, OSError) as e:
+                    await loop.run_in_executor(None, self._disconnect)
+                    failures += 1
+                    if self.reconnect_max_attempts and failures >= self.reconnect_max_attempts:
+                        logger.error(f"Publishing to {self.url} failed {failures} times in a row, giving up: {e}")
+                        self.failed = True
+                        return
+                    delay = min(self.reconnect_initial_delay * 2 ** (failures - 1), self.reconnect_max_delay)
+                    limit = f"/{self.reconnect_max_attempts}" if self.reconnect_max_attempts else ""
+                    logger.error(f"Publishing to {self.url} failed (attempt {failures}{limit}), "
+                                 f"retrying in {delay:.1f}s: {e}")
+                    await asyncio.sleep(delay)
+        finally:
+            await loop.run_in_executor(None, self._disconnect)
+
+    def _connect(self):
+        options = {"rtsp_transport": "tcp"} if self.format == "rtsp" else {}
+        self._container = av.open(self.url, mode="w", format=self.format, options=options)
+        self._stream = self._container.add_stream(self.codec, rate=self.fps)
+        self._stream.width, self._stream.height = self.size
+        self._stream.pix_fmt = self.pixel_format
+        self._stream.bit_rate = self.bitrate
+        # Millisecond timestamps follow the real capture times, so dropped frames don't speed up playback
+        self._stream.codec_context.time_base = fractions.Fraction(1, 1000)
+        if self.codec == "libx264":
+            # A keyframe every two seconds lets viewers join quickly
+            self._stream.options = {"preset": "ultrafast", "tune": "zerolatency", "g": str(self.fps * 2)}
+        try:
+            self._stream.codec_context.color_range = COLOR_RANGES[self.color_range]
+        except AttributeError:
+            pass
+        self._start = time.monotonic()
+        self._last_pts = -1
+        self.connected = True
+        logger.info(f"Publishing to {self.url}")
+
+    def _write(self, captured):
+        size = i420_size(captured.array)
+        if size != tuple(self.size):
+            # The server only learns the stream's size when it is announced, so reconnect
+            logger.info(f"Frame size changed from {self.size[0]}x{self.size[1]} to {size[0]}x{size[1]}, "
+                        f"re-announcing the stream")
+            self._disconnect()
+            self.size = size
+            self._connect()
+        pts = int((captured.monotonic - self._start) * 1000)
+        if pts <= self._last_pts:
+            return
+        self._last_pts = pts
+
+        # Repacked here rather than by swscale inside the encoder
+        array = i420_to_nv12(captured.array) if self.pixel_format == "nv12" else captured.array
+        frame = VideoFrame.from_ndarray(array, format=self.pixel_format)
+        tag_color_range(frame, self.color_range)
+        frame.pts = pts
+        frame.time_base = fractions.Fraction(1, 1000)
+        for packet in self._stream.encode(frame):
+            self._container.mux(packet)
+
+    def _disconnect(self):
+        self.connected = False
+        if self._container is None:
+            return
+        try:
+            for packet in self._stream.encode(None):
+                self._container.mux(packet)
+        except (FFmpegError, OSError):
+            # The upstream is usually already gone
+            pass
+        try:
+            self._container.close()
+        except (FFmpegError, OSError) as e:
+            logger.debug(f"Error closing publish connection: {e}")
+        self._container = None
+        self._stream = None
@@ -0,0 +1,129 @@
+#!/usr/bin/env python3
+"""
+System Health
+Monitors the Raspberry Pi's SoC temperature and firmware throttling flags.
+"""
+
+import asyncio
+import logging
+import subprocess
+
+logger = logging.getLogger("system_health")
+
+THERMAL_ZONE_PATH = "/sys/class/thermal/thermal_zone0/temp"
+BOARD_MODEL_PATH = "/proc/device-tree/model"
+
+# Pixels per second each board can capture and software-encode in real time, matched by model
+# prefix (most specific first)
+BOARD_PIXEL_RATES = [
+    ("Raspberry Pi 5", 1920 * 1080 * 30),
+    ("Raspberry Pi 4", 1280 * 720 * 30),
+    ("Raspberry Pi 3", 640 * 480 * 30),
+    ("Raspberry Pi Zero 2", 640 * 480 * 30),
+    ("Raspberry Pi", 320 * 240 * 30),
+]
+
+# Bits reported by `vcgencmd get_throttled`
+THROTTLE_FLAGS = {
+    0: "under_voltage",
+    1: "arm_frequency_capped",
+    2: "throttled",
+    3: "soft_temperature_limit",
+}
+# The same conditions, latched since boot, are reported 16 bits higher
+OCCURRED_SHIFT = 16
+
+def read_soc_temperature():
+    """Return the SoC temperature in degrees Celsius, or None if unavailable"""
+    try:
+        with open(THERMAL_ZONE_PATH, 'r') as f:
+            return int(f.read().strip()) / 1000.0
+    except (OSError, ValueError):
+        return None
+
+def read_board_model():
+    """Return the board model (e.g. "Raspberry Pi 4 Model B Rev 1.4"), or None if unknown"""
+    try:
+        with open(BOARD_MODEL_PATH, 'r') as f:
+            return f.read().strip("\x00\n ")
+    except OSError:
+        return None
+
+def default_pixel_rate(model):
+    """Return the real-time pixel rate for a board model, or None when there is no known limit"""
+    if not model:
+        return None
+    for prefix, rate in BOARD_PIXEL_RATES:
+        if model.startswith(prefix):
+            return rate
+    return None
+
+def read_throttled_flags():
+    """Return the raw throttled bitmask from vcgencmd, or None if unavailable"""
+    try:
+        output = subprocess.run(["vcgencmd", "get_throttled"], capture_output=True,
+                                text=True, timeout=2).stdout.strip()
+        # Output looks like "throttled=0x50005"
+        return int(output.split("=", 1)[1], 16)
+    except (OSError, subprocess.SubprocessError, IndexError, ValueError):
+        return None
+
+def decode_throttled_flags(mask):
+    """Split a throttled bitmask into currently active and occurred-since-boot conditions"""
+    active = [name for bit, name in THROTTLE_FLAGS.items() if mask & (1 << bit)]
+    occurred = [name for bit, name in THROTTLE_FLAGS.items() if mask & (1 << (bit + OCCURRED_SHIFT))]
+    return active, occurred
+
+class ThermalMonitor:
+    """Periodically samples temperature and throttling, warning when throttling starts.
+
+    When cap_temperature is set, fps_cap is set to cap_fps once the SoC reaches it and cleared
+    again once it has cooled by hysteresis degrees.
+    """
+
+    def __init__(self, interval=5.0, cap_temperature=None, cap_fps=None, hysteresis=5.0):
+        self.interval = interval
+        self.cap_temperature = cap_temperature
+        self.cap_fps = cap_fps
+        self.hysteresis = hysteresis
+        self.fps_cap = None
+        self.status = {"temperature_c": None, "throttled": None, "active": [], "occurred_since_boot": []}
+
+    def sample(self):
+        temperature = read_soc_temperature()
+        mask = read_throttled_flags()
+        previous_active = set(self.status["active"])
+
+        active, occurred = decode_throttled_flags(mask) if mask is not None else ([], [])
+        self.status = {
+            "temperature_c": temperature,
+            "throttled": None if mask is None else bool(active),
+            "active": active,
+            "occurred_since_boot": occurred
+        }
+
+        started = set(active) - previous_active
+        if started:
+            logger.warning(f"Pi is throttling ({', '.join(sorted(started))}) at {temperature}C - "
+                           f"expect reduced encode performance and frame rate")
+        elif previous_active and not active:
+            logger.info(f"Pi throttling cleared at {temperature}C")
+
+        self._update_fps_cap(temperature)
+        return self.status
+
+    def _update_fps_cap(self, temperature):
+        if self.cap_temperature is None or temperature is None:
+            return
+        if self.fps_cap is None and temperature >= self.cap_temperature:
+            self.fps_cap = self.cap_fps
+            logger.warning(f"SoC at {temperature}C, capping streams to {self.cap_fps} fps until it cools")
+        elif self.fps_cap is not None and temperature <= self.cap_temperature - self.hysteresis:
+            self.fps_cap = None
+            logger.info(f"SoC cooled to {temperature}C, restoring the full frame rate")
+
+    async def run(self):
+        loop = asyncio.get_event_loop()
+        while True:
+            await loop.run_in_executor(None, self.sample)
+            await asyncio.sleep(self.interval)
@@ -0,0 +1,98 @@
+#!/usr/bin/env python3
+"""
+Tests for the debounced, rate-limited control writer
+"""
+
+import asyncio
+import sys
+import time
+import unittest
+from pathlib import Path
+
+# Node modules import each other by name, so the node directory goes on the path
+sys.path.insert(0, str(Path(__file__).parent.parent))
+
+from camera_controls import ControlWriter
+
+# Slack for the event loop's timer granularity when comparing write times
+TIMING_TOLERANCE = 0.002
+
+class RecordingCamera:
+    """Stands in for a camera, recording when each control write arrived and what it held"""
+
+    def __init__(self, camera_controls=None):
+        self.camera_controls = camera_controls or {}
+        self.writes = []
+
+    def set_controls(self, values):
+        self.writes.append((time.monotonic(), dict(values)))
+
+    @property
+    def values(self):
+        return [values for _, values in self.writes]
+
+class ControlWriterTest(unittest.IsolatedAsyncioTestCase):
+    async def test_submits_inside_the_debounce_window_merge_into_one_write(self):
+        camera = RecordingCamera()
+        writer = ControlWriter(camera, max_rate=100, debounce=0.05)
+        writer.submit({"ExposureTime": 1000})
+        writer.submit({"ExposureTime": 2000, "AnalogueGain": 2.0})
+        writer.submit({"AnalogueGain": 3.0})
+        await asyncio.sleep(0.15)
+        self.assertEqual(camera.values, [{"ExposureTime": 2000, "AnalogueGain": 3.0}])
+        self.assertEqual(writer.writes, 1)
+        self.assertEqual(writer.coalesced, 2)
+
+    async def test_writes_never_come_faster_than_max_rate(self):
+        camera = RecordingCamera()
+        writer = ControlWriter(camera, max_rate=10, debounce=0.001)
+        for value in range(10):
+            writer.submit({"ExposureTime": value})
+            await asyncio.sleep(0.02)
+        await asyncio.sleep(0.2)
+        times = [written for written, _ in camera.writes]
+        self.assertGreater(len(times), 1)
+        self.assertLess(len(times), 10)
+        for earlier, later in zip(times, times[1:]):
+            self.assertGreaterEqual(later - earlier, writer.min_interval - TIMING_TOLERANCE)
+        # Whatever was held back, the latest value is the one the camera ends up with
+        self.assertEqual(camera.values[-1], {"ExposureTime": 9})
+
+    async def test_change_inside_the_deadband_returns_the_kept_value(self):
+        camera = RecordingCamera()
+        writer = ControlWriter(camera, debounce=0.01, deadband={"LensPosition": 0.05})
+        self.assertEqual(writer.submit({"LensPosition": 1.0}), {"LensPosition": 1.0})
+        await asyncio.sleep(0.05)
+        self.assertEqual(writer.submit({"LensPosition": 1.04}), {"LensPosition": 1.0})
+        await asyncio.sleep(0.05)
+        self.assertEqual(camera.values, [{"LensPosition": 1.0}])
+        self.assertEqual(writer.deadbanded, 1)
+
+    async def test_deadband_measures_from_the_last_value_accepted(self):
+        camera = RecordingCamera()
+        writer = ControlWriter(camera, debounce=0.01, deadband={"LensPosition": 0.05})
+        writer.submit({"LensPosition": 1.0})
+        # Small steps can't creep past the deadband one at a time
+        writer.submit({"LensPosition": 1.04})
+        self.assertEqual(writer.submit({"LensPosition": 1.08}), {"LensPosition": 1.08})
+        await asyncio.sleep(0.05)
+        self.assertEqual(camera.values, [{"LensPosition": 1.08}])
+
+    async def test_controls_without_a_deadband_are_always_written(self):
+        camera = RecordingCamera()
+        writer = ControlWriter(camera, debounce=0.01, deadband={"LensPosition": 0.05})
+        writer.submit({"LensPosition": 1.0, "ExposureTime": 1000})
+        applied = writer.submit({"LensPosition": 1.01, "ExposureTime": 1001})
+        self.assertEqual(applied, {"LensPosition": 1.0, "ExposureTime": 1001})
+        await asyncio.sleep(0.05)
+        self.assertEqual(camera.values, [{"LensPosition": 1.0, "ExposureTime": 1001}])
+
+    async def test_values_are_clamped_to_the_driver_range(self):
+        camera = RecordingCamera({"ExposureTime": (100, 1000, 500)})
+        writer = ControlWriter(camera, debounce=0.01)
+        self.assertEqual(writer.submit({"ExposureTime": 5000}), {"ExposureTime": 1000})
+        await asyncio.sleep(0.05)
+        self.assertEqual(camera.values, [{"ExposureTime": 1000}])
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,110 @@
+#!/usr/bin/env python3
+"""
+Tests for the send queue drop policies
+"""
+
+import asyncio
+import sys
+import unittest
+from pathlib import Path
+
+# Node modules import each other by name, so the node directory goes on the path
+sys.path.insert(0, str(Path(__file__).parent.parent))
+
+from frame_hub import FrameQueue
+from pipeline_stats import PipelineStats
+
+# How long a blocked put is given to (wrongly) complete
+BLOCK_CHECK_DELAY = 0.05
+
+async def feed_slow_consumer(queue, frames, consume_every):
+    """Put frames as fast as the capture loop would while the consumer takes one per consume_every.
+
+    Returns the frames the consumer received, in order, after draining what is left queued.
+    """
+    received = []
+    for index, frame in enumerate(frames, 1):
+        await queue.put(frame)
+        if index % consume_every == 0:
+            received.append(await queue.get(timeout=1))
+    while True:
+        try:
+            received.append(await queue.get(timeout=BLOCK_CHECK_DELAY))
+        except asyncio.TimeoutError:
+            return received
+
+class FrameQueueTest(unittest.IsolatedAsyncioTestCase):
+    async def test_drop_oldest_keeps_the_freshest_frames(self):
+        stats = PipelineStats()
+        queue = FrameQueue(1, "drop-oldest", stats)
+        received = await feed_slow_consumer(queue, range(9), consume_every=3)
+        self.assertEqual(received, [2, 5, 8])
+        self.assertEqual(queue.drops, 6)
+        self.assertEqual(stats.counters["send_queue_drops"], 6)
+
+    async def test_drop_newest_keeps_the_queued_frames(self):
+        stats = PipelineStats()
+        queue = FrameQueue(1, "drop-newest", stats)
+        received = await feed_slow_consumer(queue, range(9), consume_every=3)
+        self.assertEqual(received, [0, 3, 6])
+        self.assertEqual(queue.drops, 6)
+        self.assertEqual(stats.counters["send_queue_drops"], 6)
+
+    async def test_drop_policies_with_a_deeper_queue(self):
+        for policy, expected in (("drop-oldest", [1, 4, 5]), ("drop-newest", [0, 1, 3])):
+            with self.subTest(policy=policy):
+                queue = FrameQueue(2, policy, PipelineStats())
+                received = await feed_slow_consumer(queue, range(6), consume_every=3)
+                self.assertEqual(received, expected)
+                self.assertEqual(queue.drops, 3)
+
+    async def test_block_holds_the_producer_until_the_consumer_catches_up(self):
+        stats = PipelineStats()
+        queue = FrameQueue(1, "block", stats)
+        received = []
+
+        async def slow_consumer():
+            for _ in range(5):
+                await asyncio.sleep(0.01)
+                received.append(await queue.get(timeout=1))
+
+        consumer = asyncio.ensure_future(slow_consumer())
+        for frame in range(5):
+            await queue.put(frame)
+        await asyncio.wait_for(consumer, 1)
+        self.assertEqual(received, [0, 1, 2, 3, 4])
+        self.assertEqual(queue.drops, 0)
+        self.assertEqual(stats.counters["send_queue_drops"], 0)
+
+    async def test_block_waits_while_the_queue_is_full(self):
+        queue = FrameQueue(1, "block", PipelineStats())
+        await queue.put(0)
+        producer = asyncio.ensure_future(queue.put(1))
+        await asyncio.sleep(BLOCK_CHECK_DELAY)
+        self.assertFalse(producer.done())
+
+        self.assertEqual(await queue.get(timeout=1), 0)
+        await asyncio.wait_for(producer, 1)
+        self.assertEqual(await queue.get(timeout=1), 1)
+
+    async def test_close_releases_a_blocked_producer(self):
+        queue = FrameQueue(1, "block", PipelineStats())
+        await queue.put(0)
+        producer = asyncio.ensure_future(queue.put(1))
+        await asyncio.sleep(BLOCK_CHECK_DELAY)
+        self.assertFalse(producer.done())
+
+        await queue.close()
+        await asyncio.wait_for(producer, 1)
+        # The blocked frame is discarded along with the queue, and later frames are ignored
+        await queue.put(2)
+        with self.assertRaises(asyncio.TimeoutError):
+            await queue.get(timeout=BLOCK_CHECK_DELAY)
+        self.assertEqual(queue.drops, 0)
+
+    def test_unknown_policy(self):
+        with self.assertRaises(ValueError):
+            FrameQueue(1, "drop-random", PipelineStats())
+
+if __name__ == "__main__":
+    unittest.main()
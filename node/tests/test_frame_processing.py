@@ -0,0 +1,74 @@
+#!/usr/bin/env python3
+"""
+Tests for the numpy YUYV conversions against swscale
+"""
+
+import sys
+import unittest
+from pathlib import Path
+
+import numpy as np
+from av import VideoFrame
+
+# Node modules import each other by name, so the node directory goes on the path
+sys.path.insert(0, str(Path(__file__).parent.parent))
+
+from frame_processing import i420_to_nv12, split_i420, yuyv_to_i420, yuyv_to_nv12
+
+WIDTH, HEIGHT = 64, 32
+
+def synthetic_yuyv():
+    """A YUYV frame with a wrapping luma ramp and chroma gradients running both ways.
+
+    Adjacent lines differ in chroma, so the vertical subsampling is exercised, by odd and even
+    amounts so rounding is too.
+    """
+    rows = np.arange(HEIGHT)[:, None]
+    columns = np.arange(WIDTH)[None, :]
+    chroma_columns = np.arange(WIDTH // 2)[None, :]
+    packed = np.empty((HEIGHT, WIDTH, 2), dtype=np.uint8)
+    packed[:, :, 0] = (columns * 3 + rows * 5) % 220 + 16
+    # Each pair of pixels shares one U (first) and one V (second)
+    packed[:, 0::2, 1] = 64 + 2 * chroma_columns + rows
+    packed[:, 1::2, 1] = 200 - chroma_columns - 2 * rows
+    return packed
+
+def swscale_planes(packed):
+    """The Y, U and V planes swscale converts a YUYV frame to"""
+    frame = VideoFrame.from_ndarray(packed, format="yuyv422")
+    return split_i420(frame.reformat(width=WIDTH, height=HEIGHT, format="yuv420p").to_ndarray())
+
+class YuyvConversionTest(unittest.TestCase):
+    def assertWithinOne(self, actual, expected):
+        self.assertEqual(actual.shape, expected.shape)
+        difference = np.abs(actual.astype(np.int16) - expected.astype(np.int16))
+        self.assertLessEqual(int(difference.max()), 1)
+
+    def test_i420_matches_swscale(self):
+        packed = synthetic_yuyv()
+        frame = yuyv_to_i420(packed)
+        self.assertEqual(frame.shape, (HEIGHT * 3 // 2, WIDTH))
+        for plane, expected in zip(split_i420(frame), swscale_planes(packed)):
+            self.assertWithinOne(plane, expected)
+
+    def test_nv12_matches_swscale(self):
+        packed = synthetic_yuyv()
+        frame = yuyv_to_nv12(packed)
+        self.assertEqual(frame.shape, (HEIGHT * 3 // 2, WIDTH))
+        y, u, v = swscale_planes(packed)
+        chroma = frame[HEIGHT:]
+        self.assertWithinOne(frame[:HEIGHT], y)
+        self.assertWithinOne(chroma[:, 0::2], u)
+        self.assertWithinOne(chroma[:, 1::2], v)
+
+    def test_flat_packed_layout(self):
+        # Some drivers hand YUYV over as (height, width * 2)
+        packed = synthetic_yuyv()
+        np.testing.assert_array_equal(yuyv_to_i420(packed.reshape(HEIGHT, -1)), yuyv_to_i420(packed))
+
+    def test_i420_to_nv12_matches_direct_conversion(self):
+        packed = synthetic_yuyv()
+        np.testing.assert_array_equal(i420_to_nv12(yuyv_to_i420(packed)), yuyv_to_nv12(packed))
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,118 @@
+#!/usr/bin/env python3
+"""
+Tests for path-scoped Basic authentication
+"""
+
+import base64
+import sys
+import unittest
+from pathlib import Path
+
+from aiohttp import web
+from aiohttp.test_utils import TestClient, TestServer
+
+# Node modules import each other by name, so the node directory goes on the path
+sys.path.insert(0, str(Path(__file__).parent.parent))
+
+from http_auth import PathAuthorizer, parse_basic_auth
+
+USERS = {"admin": "s3cret", "viewer": "look"}
+PATHS = {
+    "/mjpeg": {"users": ["viewer", "admin"], "realm": "preview"},
+    "/offer": {"users": ["admin"]},
+    "/sessions": {"users": ["viewer", "admin"]},
+    "/sessions/reset-stats": {"users": ["admin"], "realm": "operators"},
+}
+
+def basic(username, password):
+    return "Basic " + base64.b64encode(f"{username}:{password}".encode()).decode()
+
+class ParseBasicAuthTest(unittest.TestCase):
+    def test_valid(self):
+        self.assertEqual(parse_basic_auth(basic("admin", "pa:ss")), ("admin", "pa:ss"))
+        self.assertEqual(parse_basic_auth(basic("admin", "s3cret").replace("Basic", "basic")), ("admin", "s3cret"))
+
+    def test_malformed(self):
+        for header in (None, "", "Basic", "Basic !!!", "Basic " + base64.b64encode(b"no-colon").decode(),
+                       "Basic " + base64.b64encode(b"\xff\xfe:x").decode(), "Bearer abc.def.ghi",
+                       "Digest username=\"admin\""):
+            with self.subTest(header=header):
+                self.assertIsNone(parse_basic_auth(header))
+
+class PathAuthorizerTest(unittest.TestCase):
+    def setUp(self):
+        self.authorizer = PathAuthorizer(USERS, PATHS)
+
+    def test_longest_prefix_wins(self):
+        self.assertEqual(self.authorizer.check("/sessions/abc/pause", basic("viewer", "look")), (True, "followspot"))
+        self.assertEqual(self.authorizer.check("/sessions/reset-stats", basic("viewer", "look")), (False, "operators"))
+        self.assertEqual(self.authorizer.check("/sessions/reset-stats", basic("admin", "s3cret")), (True, "operators"))
+
+    def test_prefix_matches_whole_path_segments(self):
+        # /mjpegx is not under /mjpeg, so no rule applies and every user may use it
+        self.assertEqual(self.authorizer.rule_for("/mjpegx"), None)
+        self.assertEqual(self.authorizer.rule_for("/mjpeg/"), PATHS["/mjpeg"])
+
+    def test_unmatched_path_is_open_to_every_user(self):
+        self.assertEqual(self.authorizer.check("/stats", basic("viewer", "look")), (True, "followspot"))
+        self.assertEqual(self.authorizer.check("/stats", None), (False, "followspot"))
+
+    def test_wrong_password_and_unknown_user(self):
+        self.assertFalse(self.authorizer.check("/mjpeg", basic("viewer", "wrong"))[0])
+        self.assertFalse(self.authorizer.check("/mjpeg", basic("viewer", ""))[0])
+        self.assertFalse(self.authorizer.check("/mjpeg", basic("nobody", ""))[0])
+
+    def test_custom_default_realm(self):
+        authorizer = PathAuthorizer(USERS, PATHS, realm="stage-left")
+        self.assertEqual(authorizer.check("/offer", None), (False, "stage-left"))
+        self.assertEqual(authorizer.check("/mjpeg", None), (False, "preview"))
+
+class PathAuthorizerMiddlewareTest(unittest.IsolatedAsyncioTestCase):
+    async def asyncSetUp(self):
+        async def ok(request):
+            return web.Response(text="ok")
+
+        app = web.Application(middlewares=[PathAuthorizer(USERS, PATHS).middleware])
+        app.router.add_get("/mjpeg", ok)
+        app.router.add_post("/offer", ok)
+        app.router.add_get("/stats", ok)
+        self.client = TestClient(TestServer(app))
+        await self.client.start_server()
+
+    async def asyncTearDown(self):
+        await self.client.close()
+
+    async def test_path_scoped_user(self):
+        # viewer may watch the preview but not start a WebRTC session
+        response = await self.client.get("/mjpeg", headers={"Authorization": basic("viewer", "look")})
+        self.assertEqual(response.status, 200)
+        response = await self.client.post("/offer", headers={"Authorization": basic("viewer", "look")})
+        self.assertEqual(response.status, 401)
+        response = await self.client.post("/offer", headers={"Authorization": basic("admin", "s3cret")})
+        self.assertEqual(response.status, 200)
+
+    async def test_challenge_uses_the_path_realm(self):
+        response = await self.client.get("/mjpeg")
+        self.assertEqual(response.status, 401)
+        self.assertEqual(response.headers["WWW-Authenticate"], 'Basic realm="preview"')
+
+    async def test_challenge_falls_back_to_the_default_realm(self):
+        for method, path in (("POST", "/offer"), ("GET", "/stats")):
+            with self.subTest(path=path):
+                response = await self.client.request(method, path)
+                self.assertEqual(response.status, 401)
+                self.assertEqual(response.headers["WWW-Authenticate"], 'Basic realm="followspot"')
+
+    async def test_malformed_or_non_basic_header(self):
+        for header in ("Basic !!!", "Basic " + base64.b64encode(b"viewer").decode(), "Bearer look"):
+            with self.subTest(header=header):
+                response = await self.client.get("/mjpeg", headers={"Authorization": header})
+                self.assertEqual(response.status, 401)
+                self.assertEqual(response.headers["WWW-Authenticate"], 'Basic realm="preview"')
+
+    async def test_wrong_password(self):
+        response = await self.client.get("/mjpeg", headers={"Authorization": basic("viewer", "s3cret")})
+        self.assertEqual(response.status, 401)
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,39 @@
+#!/usr/bin/env python3
+"""
+Tests for the frame timestamp clock
+"""
+
+import sys
+import unittest
+from pathlib import Path
+
+# Node modules import each other by name, so the node directory goes on the path
+sys.path.insert(0, str(Path(__file__).parent.parent))
+
+from media_clock import PtsClock, VIDEO_CLOCK_RATE
+
+FRAMES = 10000
+
+class PtsClockTest(unittest.TestCase):
+    def test_no_drift(self):
+        for fps in (24, 25, 29.97, 60):
+            with self.subTest(fps=fps):
+                clock = PtsClock(VIDEO_CLOCK_RATE, fps)
+                for _ in range(FRAMES):
+                    clock.next_pts()
+                self.assertEqual(clock.next_pts(), int(FRAMES * VIDEO_CLOCK_RATE / fps))
+
+    def test_first_pts_is_zero(self):
+        self.assertEqual(PtsClock(VIDEO_CLOCK_RATE, 30).next_pts(), 0)
+
+    def test_gap_lands_on_the_frame_after_it(self):
+        clock = PtsClock(VIDEO_CLOCK_RATE, 30)
+        clock.next_pts()
+        self.assertEqual(clock.next_pts(frames=3), 3 * clock.step)
+        self.assertEqual(clock.next_pts(), 4 * clock.step)
+
+    def test_first_frame_ignores_the_gap(self):
+        self.assertEqual(PtsClock(VIDEO_CLOCK_RATE, 30).next_pts(frames=5), 0)
+
+if __name__ == "__main__":
+    unittest.main()
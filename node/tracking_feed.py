@@ -0,0 +1,32 @@
+#!/usr/bin/env python3
+"""
+Tracking Feed
+A small grayscale copy of the shared capture for the beacon detector, alongside the full-size stream.
+"""
+
+import cv2
+
+from frame_processing import i420_size
+from mjpeg_streamer import MjpegStreamer
+
+def tracking_frame(array, size):
+    """Downscale the luma plane of an I420 frame to size and return it as a binary PGM image"""
+    _, height = i420_size(array)
+    gray = cv2.resize(array[:height], tuple(size), interpolation=cv2.INTER_AREA)
+    return f"P5\n{size[0]} {size[1]}\n255\n".encode() + gray.tobytes()
+
+class TrackingFeed(MjpegStreamer):
+    """Shares one downscaled grayscale frame per capture between every attached tracking client.
+
+    The luma plane already is the grayscale image, so each frame costs one resize and no
+    encode; PGM keeps it uncompressed but self-describing, so cv2.imdecode reads it directly.
+    """
+
+    label = "Tracking feed"
+
+    def __init__(self, hub, size=(320, 240), fps=30):
+        super().__init__(hub, fps=fps)
+        self.size = size
+
+    def encode(self, array):
+        return tracking_frame(array, self.size)